@@ -1,17 +1,408 @@
 package config
 
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shohag000/test-websocket/logger"
+)
+
 // Config struct def
 type Config struct {
-	Database    string
-	ThreadColl  string
-	MessageColl string
+	// MongoURI is the connection string of a replica set or sharded cluster, transactions and
+	// change streams are not supported by a standalone server
+	MongoURI string
+
+	Database       string
+	ThreadColl     string
+	MessageColl    string
+	AttachmentColl string
+	EventColl      string
+	CounterColl    string
+	DeviceColl     string
+	UserColl       string
+	OutboxColl     string
+	MigrationColl  string
+
+	WebhookDeliveryColl   string
+	WebhookDeadLetterColl string
+
+	// LogLevel is the lowest level of written log lines, one of debug, info, warn and error
+	LogLevel string
+
+	// Tracing, spans are exported to the OTLP collector at OTLPEndpoint and a TraceSampleRatio
+	// fraction of the traces which do not have a sampled parent is sampled
+	ServiceName      string
+	OTLPEndpoint     string
+	OTLPInsecure     bool
+	TraceSampleRatio float64
+
+	// MigrateOnStart applies pending migrations when the server starts, otherwise they are applied
+	// with the migrate command
+	MigrateOnStart bool
+
+	// ThreadIDKey is the secret key of thread id hashes, changing it gives new threads different
+	// ids than existing ones which are still found by their users
+	ThreadIDKey string
+
+	// RequestTimeout is the deadline of handling a websocket request, and of each unit of work of
+	// the background jobs
+	RequestTimeout time.Duration
+
+	// Rate limits of websocket requests by data type, the "*" entry applies to the data types
+	// which are not listed. A connection which is limited RateLimitStrikes times within
+	// RateLimitStrikeWindow is disconnected.
+	RateLimits            map[string]RateLimit
+	RateLimitStrikes      int
+	RateLimitStrikeWindow time.Duration
+
+	// Connection limits of the instance, of each remote address and of each user, 0 disables a
+	// limit. A user at the limit cannot authenticate another connection, unless
+	// EvictOldestConnection is set, then the oldest connection of the user is closed instead.
+	MaxConnections        int
+	MaxConnectionsPerIP   int
+	MaxConnectionsPerUser int
+	EvictOldestConnection bool
+
+	// TrustedProxies are the load balancers and proxies, as ips or cidr ranges, whose
+	// X-Forwarded-For header gives the address of clients. Without them the per address limit
+	// counts the address of the proxy.
+	TrustedProxies []*net.IPNet
+
+	// Admin api, it is disabled without a token
+	AdminToken string
+	AdminRoute string
+
+	// Health checks time out after HealthCheckTimeout. On shutdown the instance reports that it is
+	// not ready for ShutdownDelay before it stops accepting connections.
+	HealthCheckTimeout time.Duration
+	ShutdownDelay      time.Duration
+
+	// Sync log, a reconnecting client which missed more events than MaxCatchUpEvents
+	// receives its inbox instead
+	CatchUpPageSize  int64
+	MaxCatchUpEvents int64
+
+	// Attachment limits
+	MaxAttachmentSize       int64
+	AllowedAttachmentTypes  []string
+	AttachmentDownloadRoute string
+
+	// Image attachments
+	ThumbnailSize  int
+	MaxImagePixels int
+
+	// Blob storage, BlobStore is either "local" or "s3"
+	BlobStore    string
+	LocalBlobDir string
+	S3           S3Config
+
+	// Push notifications, messages within the collapse window are sent as one notification
+	PushCollapseWindow time.Duration
+	PushWorkers        int
+	FCM                FCMConfig
+	APNs               APNsConfig
+
+	// Email digest of unread messages for users who have been away for DigestInactivity,
+	// checked every DigestInterval
+	DigestInterval   time.Duration
+	DigestInactivity time.Duration
+	SMTP             SMTPConfig
+
+	// Outbox relay, pending entries are polled every OutboxPollInterval in addition to the change
+	// stream, a claimed entry is published again if it is not marked within OutboxLease. Published
+	// entries are removed after OutboxRetention.
+	OutboxPollInterval time.Duration
+	OutboxLease        time.Duration
+	OutboxRetention    time.Duration
+
+	// Outbound webhooks, failed deliveries are retried with exponential backoff starting at
+	// WebhookRetryDelay and moved to the dead letter collection after WebhookMaxAttempts
+	Webhooks           []WebhookSubscription
+	WebhookMaxAttempts int
+	WebhookRetryDelay  time.Duration
+	WebhookWorkers     int
+}
+
+// S3Config defines the settings of an S3 compatible blob store
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	ForcePathStyle  bool
+}
+
+// FCMConfig defines the settings of firebase cloud messaging, it is disabled without a service
+// account key file. The project id defaults to the project of the service account.
+type FCMConfig struct {
+	Endpoint        string
+	CredentialsFile string
+	ProjectID       string
+}
+
+// APNsConfig defines the settings of apple push notifications, it is disabled without a key file
+type APNsConfig struct {
+	Endpoint string
+	KeyFile  string
+	KeyID    string
+	TeamID   string
+	Topic    string
+}
+
+// SMTPConfig defines the mail server used to send emails, it is disabled without a host and sender
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// RateLimit defines the token bucket limits of a data type for each connection and for all
+// connections of a user, a zero rate does not limit requests
+type RateLimit struct {
+	ConnectionRate  float64 `json:"connectionRate"`
+	ConnectionBurst int     `json:"connectionBurst"`
+	UserRate        float64 `json:"userRate"`
+	UserBurst       int     `json:"userBurst"`
+}
+
+// WebhookSubscription defines an endpoint which receives the listed events, an empty list
+// subscribes to all events. Payloads are signed with the secret.
+type WebhookSubscription struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
 }
 
 // New returns a new config
 func New() Config {
 	return Config{
-		Database:    "messaging",
-		ThreadColl:  "thread",
-		MessageColl: "message",
+		MongoURI: getEnv("MONGO_URI", "mongodb://mongo:27017/?replicaSet=rs0"),
+
+		Database:       "messaging",
+		ThreadColl:     "thread",
+		MessageColl:    "message",
+		AttachmentColl: "attachment",
+		EventColl:      "event",
+		CounterColl:    "counter",
+		DeviceColl:     "device",
+		UserColl:       "user",
+		OutboxColl:     "outbox",
+		MigrationColl:  "migration",
+
+		WebhookDeliveryColl:   "webhook_delivery",
+		WebhookDeadLetterColl: "webhook_dead_letter",
+
+		LogLevel: getEnv("LOG_LEVEL", "info"),
+
+		ServiceName:      getEnv("OTEL_SERVICE_NAME", "messaging"),
+		OTLPEndpoint:     getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		OTLPInsecure:     getEnv("OTEL_EXPORTER_OTLP_INSECURE", "false") == "true",
+		TraceSampleRatio: getEnvFloat("TRACE_SAMPLE_RATIO", 1),
+
+		MigrateOnStart: getEnv("MIGRATE_ON_START", "true") == "true",
+
+		ThreadIDKey: getEnv("THREAD_ID_KEY", ""),
+
+		RequestTimeout: getEnvDuration("REQUEST_TIMEOUT", 10*time.Second),
+
+		RateLimits: getEnvRateLimits("RATE_LIMITS", map[string]RateLimit{
+			"*":           {ConnectionRate: 20, ConnectionBurst: 40, UserRate: 40, UserBurst: 80},
+			"MessageData": {ConnectionRate: 5, ConnectionBurst: 10, UserRate: 10, UserBurst: 20},
+		}),
+		RateLimitStrikes:      int(getEnvInt("RATE_LIMIT_STRIKES", 20)),
+		RateLimitStrikeWindow: getEnvDuration("RATE_LIMIT_STRIKE_WINDOW", time.Minute),
+
+		MaxConnections:        int(getEnvInt("MAX_CONNECTIONS", 10000)),
+		MaxConnectionsPerIP:   int(getEnvInt("MAX_CONNECTIONS_PER_IP", 100)),
+		MaxConnectionsPerUser: int(getEnvInt("MAX_CONNECTIONS_PER_USER", 10)),
+		EvictOldestConnection: getEnv("EVICT_OLDEST_CONNECTION", "false") == "true",
+		TrustedProxies:        getEnvNetworks("TRUSTED_PROXIES"),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+		AdminRoute: "/admin/",
+
+		HealthCheckTimeout: getEnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second),
+		ShutdownDelay:      getEnvDuration("SHUTDOWN_DELAY", 5*time.Second),
+
+		CatchUpPageSize:  200,
+		MaxCatchUpEvents: getEnvInt("MAX_CATCH_UP_EVENTS", 5000),
+
+		MaxAttachmentSize: getEnvInt("ATTACHMENT_MAX_SIZE", 10<<20),
+		AllowedAttachmentTypes: getEnvList("ATTACHMENT_ALLOWED_TYPES", []string{
+			"image/jpeg",
+			"image/png",
+			"image/gif",
+			"application/pdf",
+			"text/plain",
+		}),
+		AttachmentDownloadRoute: "/attachments/",
+
+		ThumbnailSize:  int(getEnvInt("THUMBNAIL_SIZE", 320)),
+		MaxImagePixels: int(getEnvInt("IMAGE_MAX_PIXELS", 40000000)),
+
+		BlobStore:    getEnv("BLOB_STORE", "local"),
+		LocalBlobDir: getEnv("BLOB_LOCAL_DIR", "data/blobs"),
+		S3: S3Config{
+			Endpoint:        getEnv("S3_ENDPOINT", ""),
+			Region:          getEnv("S3_REGION", "us-east-1"),
+			Bucket:          getEnv("S3_BUCKET", "messaging-attachments"),
+			AccessKeyID:     getEnv("S3_ACCESS_KEY_ID", ""),
+			SecretAccessKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+			ForcePathStyle:  getEnv("S3_FORCE_PATH_STYLE", "false") == "true",
+		},
+
+		PushCollapseWindow: getEnvDuration("PUSH_COLLAPSE_WINDOW", 10*time.Second),
+		PushWorkers:        int(getEnvInt("PUSH_WORKERS", 4)),
+		FCM: FCMConfig{
+			Endpoint:        getEnv("FCM_ENDPOINT", "https://fcm.googleapis.com"),
+			CredentialsFile: getEnv("FCM_CREDENTIALS_FILE", ""),
+			ProjectID:       getEnv("FCM_PROJECT_ID", ""),
+		},
+		APNs: APNsConfig{
+			Endpoint: getEnv("APNS_ENDPOINT", "https://api.push.apple.com"),
+			KeyFile:  getEnv("APNS_KEY_FILE", ""),
+			KeyID:    getEnv("APNS_KEY_ID", ""),
+			TeamID:   getEnv("APNS_TEAM_ID", ""),
+			Topic:    getEnv("APNS_TOPIC", ""),
+		},
+
+		DigestInterval:   getEnvDuration("DIGEST_INTERVAL", time.Hour),
+		DigestInactivity: getEnvDuration("DIGEST_INACTIVITY", 24*time.Hour),
+		SMTP: SMTPConfig{
+			Host:     getEnv("SMTP_HOST", ""),
+			Port:     int(getEnvInt("SMTP_PORT", 587)),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", ""),
+		},
+
+		OutboxPollInterval: getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		OutboxLease:        getEnvDuration("OUTBOX_LEASE", 30*time.Second),
+		OutboxRetention:    getEnvDuration("OUTBOX_RETENTION", 7*24*time.Hour),
+
+		Webhooks:           getEnvWebhooks("WEBHOOK_SUBSCRIPTIONS"),
+		WebhookMaxAttempts: int(getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8)),
+		WebhookRetryDelay:  getEnvDuration("WEBHOOK_RETRY_DELAY", time.Second),
+		WebhookWorkers:     int(getEnvInt("WEBHOOK_WORKERS", 4)),
+	}
+}
+
+// getEnv returns the value of the environment variable or the default value if it is not set
+func getEnv(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// getEnvInt returns the integer value of the environment variable or the default value if it is
+// not set or invalid
+func getEnvInt(key string, def int64) int64 {
+	v, err := strconv.ParseInt(getEnv(key, ""), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvFloat returns the float value of the environment variable or the default value if it is
+// not set or invalid
+func getEnvFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(getEnv(key, ""), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvDuration returns the duration value of the environment variable or the default value if it
+// is not set or invalid
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvList returns the comma separated values of the environment variable or the default values
+// if it is not set
+func getEnvList(key string, def []string) []string {
+	v := getEnv(key, "")
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// getEnvNetworks returns the comma separated ips and cidr ranges of the environment variable,
+// invalid entries are reported and ignored
+func getEnvNetworks(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, s := range getEnvList(key, nil) {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			logger.Default().Error("could not parse environment variable", "key", key, "error", err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// getEnvWebhooks returns the webhook subscriptions from the json array in the environment
+// variable, invalid json is reported and ignored
+func getEnvWebhooks(key string) []WebhookSubscription {
+	v := getEnv(key, "")
+	if v == "" {
+		return nil
+	}
+	var subs []WebhookSubscription
+	err := json.Unmarshal([]byte(v), &subs)
+	if err != nil {
+		logger.Default().Error("could not parse environment variable", "key", key, "error", err)
+		return nil
+	}
+	return subs
+}
+
+// getEnvRateLimits returns the default rate limits with the limits of the json object in the
+// environment variable applied over them, invalid json is reported and ignored
+func getEnvRateLimits(key string, def map[string]RateLimit) map[string]RateLimit {
+	v := getEnv(key, "")
+	if v == "" {
+		return def
+	}
+	var limits map[string]RateLimit
+	err := json.Unmarshal([]byte(v), &limits)
+	if err != nil {
+		logger.Default().Error("could not parse environment variable", "key", key, "error", err)
+		return def
+	}
+	for dataType, limit := range limits {
+		def[dataType] = limit
 	}
+	return def
 }
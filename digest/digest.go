@@ -0,0 +1,180 @@
+package digest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/repository"
+)
+
+// maxDigestMessages is the maximum number of unread messages summarized in one digest
+const maxDigestMessages = 100
+
+// maxPreviewLength is the maximum number of characters of the latest message of a thread
+const maxPreviewLength = 200
+
+// Store defines the data the digest job reads and updates
+type Store interface {
+	GetDigestCandidates(ctx context.Context, seenBefore, digestBefore time.Time) ([]*model.UserSettings, error)
+	GetUnreadMessages(ctx context.Context, userID string, since time.Time, limit int64) ([]*model.Message, error)
+	// ClaimDigest sets the last digest time of the user to sentAt unless it is after digestBefore,
+	// and reports whether it did
+	ClaimDigest(ctx context.Context, userID string, digestBefore, sentAt time.Time) (bool, error)
+	// ReleaseDigest restores the last digest time of a claim whose digest was not sent
+	ReleaseDigest(ctx context.Context, userID string, sentAt, lastDigestAt time.Time) error
+}
+
+// Job periodically emails users who have been away a digest of their unread messages
+type Job struct {
+	store      Store
+	mailer     Mailer
+	interval   time.Duration
+	inactivity time.Duration
+	timeout    time.Duration
+}
+
+// Run runs the job every interval
+func (j *Job) Run() {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := j.RunOnce(context.Background(), time.Now())
+		if err != nil {
+			logger.Default().Error("could not send digests", "error", err)
+		}
+	}
+}
+
+// RunOnce sends a digest to every user who has been away for the inactivity period, has unread
+// messages and did not receive a digest within the inactivity period. Each query and digest is
+// given the configured timeout. Users are claimed before their digest is sent, so instances which
+// run the job at the same time send each digest once.
+func (j *Job) RunOnce(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-j.inactivity)
+	qctx, cancel := context.WithTimeout(ctx, j.timeout)
+	users, err := j.store.GetDigestCandidates(qctx, cutoff, cutoff)
+	cancel()
+	if err != nil {
+		var partial *repository.PartialError
+		if !errors.As(err, &partial) {
+			return fmt.Errorf("could not fetch digest candidates: %v", err)
+		}
+		logger.FromContext(ctx).Warn("could not load some digest candidates", "error", err)
+	}
+
+	for _, user := range users {
+		log := logger.FromContext(ctx).With("userId", user.UserID)
+		uctx, cancel := context.WithTimeout(logger.NewContext(ctx, log), j.timeout)
+		err := j.sendDigest(uctx, user, cutoff, now)
+		cancel()
+		if err != nil {
+			log.Error("could not send digest", "error", err)
+		}
+	}
+
+	return nil
+}
+
+func (j *Job) sendDigest(ctx context.Context, user *model.UserSettings, cutoff, now time.Time) error {
+	// Messages are unread if they arrived after the user was last seen or last emailed
+	since := user.LastSeenAt
+	if user.LastDigestAt.After(since) {
+		since = user.LastDigestAt
+	}
+
+	// The digest summarizes the messages which could be loaded
+	msgs, err := j.store.GetUnreadMessages(ctx, user.UserID, since, maxDigestMessages)
+	if err != nil {
+		var partial *repository.PartialError
+		if !errors.As(err, &partial) {
+			return fmt.Errorf("could not fetch unread messages: %v", err)
+		}
+		logger.FromContext(ctx).Warn("could not load some unread messages", "error", err)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	email, err := render(user.Email, msgs)
+	if err != nil {
+		return fmt.Errorf("could not render digest: %v", err)
+	}
+
+	// Another instance sent the digest if the claim fails
+	claimed, err := j.store.ClaimDigest(ctx, user.UserID, cutoff, now)
+	if err != nil {
+		return fmt.Errorf("could not claim digest: %v", err)
+	}
+	if !claimed {
+		return nil
+	}
+
+	err = j.mailer.Send(ctx, email)
+	if err != nil {
+		// The digest is sent again on the next run, also when the deadline of the send passed
+		rctx, cancel := context.WithTimeout(context.Background(), j.timeout)
+		rerr := j.store.ReleaseDigest(rctx, user.UserID, now, user.LastDigestAt)
+		cancel()
+		if rerr != nil {
+			logger.FromContext(ctx).Error("could not release digest", "error", rerr)
+		}
+		return fmt.Errorf("could not send email: %v", err)
+	}
+
+	return nil
+}
+
+// render renders the digest email of the messages, grouped by thread
+func render(to string, msgs []*model.Message) (*Email, error) {
+	data := digestData{Total: len(msgs)}
+	threads := map[string]*threadSummary{}
+	for _, msg := range msgs {
+		ts, ok := threads[msg.ThreadID]
+		if !ok {
+			ts = &threadSummary{ThreadID: msg.ThreadID, SenderID: msg.SenderID}
+			threads[msg.ThreadID] = ts
+			data.Threads = append(data.Threads, ts)
+		}
+		ts.Count++
+		ts.Latest = msg.Preview(maxPreviewLength)
+	}
+
+	var text, html bytes.Buffer
+	err := textTemplate.Execute(&text, data)
+	if err != nil {
+		return nil, err
+	}
+	err = htmlTemplate.Execute(&html, data)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := "You have 1 unread message"
+	if data.Total > 1 {
+		subject = fmt.Sprintf("You have %d unread messages", data.Total)
+	}
+
+	return &Email{
+		To:      to,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// NewJob returns a digest job with the interval and inactivity period from the config
+func NewJob(store Store, mailer Mailer, cfg config.Config) *Job {
+	return &Job{
+		store:      store,
+		mailer:     mailer,
+		interval:   cfg.DigestInterval,
+		inactivity: cfg.DigestInactivity,
+		timeout:    cfg.RequestTimeout,
+	}
+}
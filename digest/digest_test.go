@@ -0,0 +1,217 @@
+package digest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/model"
+)
+
+// smtpServer is a local stand-in of a mail server which records the recipients of the messages
+// it accepts
+type smtpServer struct {
+	ln net.Listener
+
+	mu         sync.Mutex
+	recipients []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ready")
+	var to []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			to = append(to, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			s.mu.Lock()
+			s.recipients = append(s.recipients, to...)
+			s.mu.Unlock()
+			to = nil
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpServer) config() config.SMTPConfig {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return config.SMTPConfig{Host: addr.IP.String(), Port: addr.Port, From: "digest@example.com"}
+}
+
+func (s *smtpServer) Recipients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.recipients...)
+}
+
+// fakeStore keeps the users of the digest in memory, which all instances share like the database
+type fakeStore struct {
+	mu    sync.Mutex
+	users map[string]*model.UserSettings
+}
+
+func (fs *fakeStore) GetDigestCandidates(ctx context.Context, seenBefore, digestBefore time.Time) ([]*model.UserSettings, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var users []*model.UserSettings
+	for _, u := range fs.users {
+		if u.LastSeenAt.Before(seenBefore) && u.LastDigestAt.Before(digestBefore) {
+			copy := *u
+			users = append(users, &copy)
+		}
+	}
+	return users, nil
+}
+
+func (fs *fakeStore) GetUnreadMessages(ctx context.Context, userID string, since time.Time, limit int64) ([]*model.Message, error) {
+	return []*model.Message{
+		{ThreadID: "t", SenderID: "friend", ReceiverID: userID, MessageType: model.Text, MessageBody: "hi"},
+	}, nil
+}
+
+func (fs *fakeStore) ClaimDigest(ctx context.Context, userID string, digestBefore, sentAt time.Time) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	u := fs.users[userID]
+	if !u.LastDigestAt.Before(digestBefore) {
+		return false, nil
+	}
+	u.LastDigestAt = sentAt
+	return true, nil
+}
+
+func (fs *fakeStore) ReleaseDigest(ctx context.Context, userID string, sentAt, lastDigestAt time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	u := fs.users[userID]
+	if u.LastDigestAt.Equal(sentAt) {
+		u.LastDigestAt = lastDigestAt
+	}
+	return nil
+}
+
+func newFakeStore(n int) *fakeStore {
+	fs := &fakeStore{users: map[string]*model.UserSettings{}}
+	for i := 0; i < n; i++ {
+		id := "user" + strconv.Itoa(i)
+		fs.users[id] = &model.UserSettings{UserID: id, Email: id + "@example.com"}
+	}
+	return fs
+}
+
+func TestRunOnceSendsEachDigestOnce(t *testing.T) {
+	server := newSMTPServer(t)
+	defer server.ln.Close()
+	store := newFakeStore(5)
+	cfg := config.Config{DigestInactivity: time.Hour, RequestTimeout: 5 * time.Second}
+
+	// Replicas run the job at the same time
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		job := NewJob(store, NewSMTPMailer(server.config()), cfg)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := job.RunOnce(context.Background(), now)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sent := map[string]int{}
+	for _, to := range server.Recipients() {
+		sent[to]++
+	}
+	for id, u := range store.users {
+		if sent[u.Email] != 1 {
+			t.Errorf("%s received %d digests, want 1", id, sent[u.Email])
+		}
+	}
+
+	// The next run within the inactivity period sends nothing
+	err := NewJob(store, NewSMTPMailer(server.config()), cfg).RunOnce(context.Background(), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Recipients()); n != 5 {
+		t.Errorf("sent %d digests in total, want 5", n)
+	}
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, email *Email) error {
+	return errors.New("mail server is down")
+}
+
+func TestFailedDigestIsReleased(t *testing.T) {
+	store := newFakeStore(1)
+	cfg := config.Config{DigestInactivity: time.Hour, RequestTimeout: 5 * time.Second}
+
+	err := NewJob(store, failingMailer{}, cfg).RunOnce(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := store.users["user0"].LastDigestAt; !at.IsZero() {
+		t.Errorf("last digest time is %v after a failed send, want it released", at)
+	}
+}
@@ -0,0 +1,48 @@
+package digest
+
+import (
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// digestData is rendered by the digest templates
+type digestData struct {
+	Total   int
+	Threads []*threadSummary
+}
+
+// threadSummary summarizes the unread messages of a thread
+type threadSummary struct {
+	ThreadID string
+	SenderID string
+	Count    int
+	Latest   string
+}
+
+const textDigest = `You have {{.Total}} unread message{{if ne .Total 1}}s{{end}}.
+{{range .Threads}}
+{{.SenderID}} sent you {{.Count}} message{{if ne .Count 1}}s{{end}}:
+  {{.Latest}}
+{{end}}
+Open the app to reply. You can turn off these emails in your settings.
+`
+
+const htmlDigest = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+<p>You have <b>{{.Total}}</b> unread message{{if ne .Total 1}}s{{end}}.</p>
+{{range .Threads}}
+<div style="margin: 1em 0; padding: 0.5em; border-left: 3px solid #ccc;">
+<p><b>{{.SenderID}}</b> sent you {{.Count}} message{{if ne .Count 1}}s{{end}}:</p>
+<p>{{.Latest}}</p>
+</div>
+{{end}}
+<p>Open the app to reply. You can turn off these emails in your settings.</p>
+</body>
+</html>
+`
+
+var (
+	textTemplate = texttemplate.Must(texttemplate.New("digest").Parse(textDigest))
+	htmlTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(htmlDigest))
+)
@@ -0,0 +1,89 @@
+package eventbus
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/shohag000/test-websocket/logger"
+)
+
+// Event is a domain event of the messaging service. The ID is unique per event so that
+// subscribers can drop events which are published more than once.
+type Event struct {
+	ID   string
+	Name string
+	Data interface{}
+
+	// TraceParent is the span which published the event, handlers continue its trace
+	TraceParent string
+}
+
+// Handler handles a published event, handlers run in the publishing goroutine so they must
+// queue any slow work instead of doing it inline. A handler returns an error if the event must be
+// published again, the event is then published again to every handler, so handlers drop the
+// events they have handled before by the event id.
+type Handler func(e Event) error
+
+// Bus delivers the domain events of the messaging service to its subscribers
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+	all      []Handler
+}
+
+// Subscribe registers the handler for the named event
+func (b *Bus) Subscribe(name string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[name] = append(b.handlers[name], h)
+}
+
+// SubscribeAll registers the handler for every event
+func (b *Bus) SubscribeAll(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.all = append(b.all, h)
+}
+
+// Publish calls the handlers of the event in the order they subscribed, and returns an error if
+// any of them failed
+func (b *Bus) Publish(e Event) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler{}, b.handlers[e.Name]...), b.all...)
+	b.mu.RUnlock()
+
+	var first error
+	failed := 0
+	for _, h := range handlers {
+		err := call(h, e)
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d handlers failed: %w", failed, len(handlers), first)
+	}
+	return nil
+}
+
+// call runs the handler, a panicking handler is logged and fails so it does not affect the
+// publisher or the other handlers
+func call(h Handler, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Default().Error("event handler panicked", "event", e.Name, "eventId", e.ID, "panic", fmt.Sprint(r))
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return h(e)
+}
+
+// New returns an empty bus
+func New() *Bus {
+	return &Bus{
+		handlers: make(map[string][]Handler),
+	}
+}
@@ -3,8 +3,12 @@ module github.com/shohag000/test-websocket
 go 1.13
 
 require (
+	github.com/aws/aws-sdk-go v1.34.28
 	github.com/gorilla/websocket v1.4.2
-	github.com/mitchellh/hashstructure v1.1.0
 	github.com/mitchellh/mapstructure v1.4.1
+	github.com/prometheus/client_golang v1.7.1
 	go.mongodb.org/mongo-driver v1.5.0
+	go.opentelemetry.io/otel v0.9.0
+	go.opentelemetry.io/otel/exporters/otlp v0.9.0
+	google.golang.org/grpc v1.30.0
 )
@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/media"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/tracing"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrAttachmentTooLarge is returned when an uploaded file exceeds the configured size limit
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	// ErrAttachmentTypeNotAllowed is returned when an uploaded file has a content type which is not allowed
+	ErrAttachmentTypeNotAllowed = errors.New("attachment type is not allowed")
+	// ErrInvalidImage is returned when an uploaded image cannot be processed
+	ErrInvalidImage = errors.New("invalid image")
+	// ErrAttachmentNotFound is returned when a message references an attachment which does not
+	// exist or belongs to another user
+	ErrAttachmentNotFound = fmt.Errorf("attachment %w", errorcodes.ErrNotFound)
+)
+
+func (ms *messagingService) UploadAttachment(ctx context.Context, ownerID, fileName string, r io.Reader) (*model.Attachment, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.UploadAttachment")
+	defer span.End()
+
+	// Sniff the content type instead of trusting the client
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read attachment: %w", err)
+	}
+	contentType := strings.TrimSpace(strings.Split(http.DetectContentType(head), ";")[0])
+	if !ms.isAllowedType(contentType) {
+		return nil, fmt.Errorf("%w: '%s'", ErrAttachmentTypeNotAllowed, contentType)
+	}
+
+	id := primitive.NewObjectID().Hex()
+	attachment := &model.Attachment{
+		AttachmentID: id,
+		OwnerID:      ownerID,
+		FileName:     cleanFileName(fileName),
+		ContentType:  contentType,
+		StorageKey:   "attachments/" + id,
+		CreatedAt:    time.Now(),
+	}
+
+	// Store the content, the limited reader fails the upload once it exceeds the size limit
+	lr := &limitedReader{r: br, max: ms.config.MaxAttachmentSize}
+	if media.IsImage(contentType) {
+		err = ms.storeImage(ctx, attachment, lr)
+	} else {
+		err = ms.blobs.Put(ctx, attachment.StorageKey, lr, -1, contentType)
+		attachment.Size = lr.n
+	}
+	// Blob stores wrap the read error without unwrapping it, so the reader records the overflow
+	if lr.exceeded {
+		ms.deleteBlobs(attachment)
+		return nil, fmt.Errorf("%w: must not be larger than %d bytes", ErrAttachmentTooLarge, ms.config.MaxAttachmentSize)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidImage) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not store attachment content: %w", err)
+	}
+
+	// Store attachment details
+	err = ms.repo.StoreAttachment(ctx, attachment)
+	if err != nil {
+		ms.deleteBlobs(attachment)
+		return nil, fmt.Errorf("could not store attachment: %w", err)
+	}
+
+	ms.setAttachmentURLs(attachment)
+	return attachment, nil
+}
+
+// storeImage stores the image without its metadata together with a thumbnail
+func (ms *messagingService) storeImage(ctx context.Context, attachment *model.Attachment, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	img, err := media.ProcessImage(data, attachment.ContentType, ms.config.ThumbnailSize, ms.config.MaxImagePixels)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	attachment.Size = int64(len(img.Content))
+	attachment.Width = img.Width
+	attachment.Height = img.Height
+	attachment.Thumbnail = &model.Thumbnail{
+		ContentType: img.ThumbnailContentType,
+		Size:        int64(len(img.Thumbnail)),
+		Width:       img.ThumbnailWidth,
+		Height:      img.ThumbnailHeight,
+		StorageKey:  "thumbnails/" + attachment.AttachmentID,
+	}
+
+	err = ms.blobs.Put(ctx, attachment.StorageKey, bytes.NewReader(img.Content), attachment.Size, attachment.ContentType)
+	if err != nil {
+		return err
+	}
+	err = ms.blobs.Put(ctx, attachment.Thumbnail.StorageKey, bytes.NewReader(img.Thumbnail), attachment.Thumbnail.Size, attachment.Thumbnail.ContentType)
+	if err != nil {
+		ms.blobs.Delete(context.Background(), attachment.StorageKey)
+		return err
+	}
+
+	return nil
+}
+
+// deleteBlobs removes the blobs of a failed upload, the upload's context may be done already so
+// it is not used
+func (ms *messagingService) deleteBlobs(attachment *model.Attachment) {
+	ms.blobs.Delete(context.Background(), attachment.StorageKey)
+	if attachment.Thumbnail != nil {
+		ms.blobs.Delete(context.Background(), attachment.Thumbnail.StorageKey)
+	}
+}
+
+func (ms *messagingService) OpenAttachment(ctx context.Context, userID, attachmentID string, thumbnail bool) (*model.Attachment, io.ReadCloser, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.OpenAttachment")
+	defer span.End()
+
+	attachment, err := ms.repo.FindAttachmentByID(ctx, attachmentID)
+	if err != nil {
+		if errors.Is(err, errorcodes.ErrNotFound) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("could not find attachment: %w", err)
+	}
+
+	// Only the owner and the participants of the thread it was shared in can download it
+	if attachment.OwnerID != userID {
+		if attachment.ThreadID == "" {
+			return nil, nil, ErrNotParticipant
+		}
+		thread, err := ms.repo.FindThreadByID(ctx, attachment.ThreadID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not find thread: %w", err)
+		}
+		if thread.UserID1 != userID && thread.UserID2 != userID {
+			return nil, nil, ErrNotParticipant
+		}
+	}
+
+	key := attachment.StorageKey
+	if thumbnail {
+		if attachment.Thumbnail == nil {
+			return nil, nil, errorcodes.ErrNotFound
+		}
+		key = attachment.Thumbnail.StorageKey
+	}
+
+	content, err := ms.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open attachment content: %w", err)
+	}
+
+	ms.setAttachmentURLs(attachment)
+	return attachment, content, nil
+}
+
+// attachFile links the attachment referenced by a file message to the thread and fills the file
+// details of the body from the stored attachment
+func (ms *messagingService) attachFile(ctx context.Context, senderID, threadID string, body *model.FileBody) error {
+	attachment, err := ms.repo.FindAttachmentByID(ctx, body.AttachmentID)
+	if err != nil {
+		if errors.Is(err, errorcodes.ErrNotFound) {
+			return ErrAttachmentNotFound
+		}
+		return err
+	}
+
+	// Do not reveal attachments of other users
+	if attachment.OwnerID != senderID {
+		return ErrAttachmentNotFound
+	}
+
+	err = ms.repo.SetAttachmentThread(ctx, attachment.AttachmentID, threadID)
+	if err != nil {
+		return err
+	}
+
+	body.FileName = attachment.FileName
+	body.ContentType = attachment.ContentType
+	body.Size = attachment.Size
+	body.Width = attachment.Width
+	body.Height = attachment.Height
+
+	ms.setAttachmentURLs(attachment)
+	body.URL = attachment.URL
+	if attachment.Thumbnail != nil {
+		body.ThumbnailURL = attachment.Thumbnail.URL
+	}
+	return nil
+}
+
+func (ms *messagingService) isAllowedType(contentType string) bool {
+	for _, t := range ms.config.AllowedAttachmentTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// setAttachmentURLs sets the download urls of the attachment and its thumbnail
+func (ms *messagingService) setAttachmentURLs(attachment *model.Attachment) {
+	attachment.URL = ms.config.AttachmentDownloadRoute + attachment.AttachmentID
+	if attachment.Thumbnail != nil {
+		attachment.Thumbnail.URL = attachment.URL + "/thumbnail"
+	}
+}
+
+// cleanFileName strips any path from the client supplied file name and limits its length
+func cleanFileName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.Replace(name, "\\", "/", -1)))
+	if name == "." || name == "/" || name == "" {
+		return "file"
+	}
+	for utf8.RuneCountInString(name) > model.MaxLabelLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// limitedReader counts the bytes read and fails once more than max bytes are read, exceeded is
+// set when it failed
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	max      int64
+	exceeded bool
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.n > lr.max {
+		lr.exceeded = true
+		return n, ErrAttachmentTooLarge
+	}
+	return n, err
+}
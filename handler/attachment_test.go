@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/repository"
+	"github.com/shohag000/test-websocket/storage"
+)
+
+// attachmentRepo stores attachment details, the other methods are not used by uploads
+type attachmentRepo struct {
+	repository.MessagingRepository
+}
+
+func (ar attachmentRepo) StoreAttachment(ctx context.Context, attachment *model.Attachment) error {
+	return nil
+}
+
+// s3Server is a local stand-in of an S3 compatible store which keeps objects in memory
+type s3Server struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[r.URL.Path] = data
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *s3Server) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+// testUpload uploads content of the size to a service with the blob store and a limit of 1 KiB
+func testUpload(t *testing.T, blobs storage.BlobStore, size int) error {
+	ms := &messagingService{
+		repo:  attachmentRepo{},
+		blobs: blobs,
+		config: config.Config{
+			MaxAttachmentSize:      1024,
+			AllowedAttachmentTypes: []string{"text/plain"},
+		},
+	}
+	_, err := ms.UploadAttachment(context.Background(), "owner", "notes.txt", strings.NewReader(strings.Repeat("a", size)))
+	return err
+}
+
+func TestUploadTooLargeLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs, err := storage.NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testUpload(t, blobs, 2048)
+	if !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("error is %v, want %v", err, ErrAttachmentTooLarge)
+	}
+	err = testUpload(t, blobs, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadTooLargeS3(t *testing.T) {
+	stand := &s3Server{objects: map[string][]byte{}}
+	server := httptest.NewServer(stand)
+	defer server.Close()
+	blobs, err := storage.NewS3Store(config.S3Config{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "attachments",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		ForcePathStyle:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testUpload(t, blobs, 2048)
+	if !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("error is %v, want %v", err, ErrAttachmentTooLarge)
+	}
+	if n := stand.count(); n != 0 {
+		t.Errorf("store has %d objects after a rejected upload", n)
+	}
+
+	// Uploads within the limit reach the store
+	err = testUpload(t, blobs, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stand.count(); n != 1 {
+		t.Errorf("store has %d objects after an upload, want 1", n)
+	}
+}
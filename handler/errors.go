@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/metrics"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/tracing"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// ErrorCode is a stable error code sent to clients as model.Error.Code
+type ErrorCode string
+
+// Error codes of the catalogue
+const (
+	CodeInvalidData              ErrorCode = "InvalidData"
+	CodeInvalidDataType          ErrorCode = "InvalidDataType"
+	CodeInvalidToken             ErrorCode = "InvalidToken"
+	CodeUnauthenticated          ErrorCode = "Unauthenticated"
+	CodeNotFound                 ErrorCode = "NotFound"
+	CodeNotParticipant           ErrorCode = "NotParticipant"
+	CodeUnknownMessageType       ErrorCode = "UnknownMessageType"
+	CodeInvalidMessageBody       ErrorCode = "InvalidMessageBody"
+	CodeInvalidSwapTransition    ErrorCode = "InvalidSwapTransition"
+	CodeAttachmentNotFound       ErrorCode = "AttachmentNotFound"
+	CodeAttachmentTooLarge       ErrorCode = "AttachmentTooLarge"
+	CodeAttachmentTypeNotAllowed ErrorCode = "AttachmentTypeNotAllowed"
+	CodeInvalidImage             ErrorCode = "InvalidImage"
+	CodeMethodNotAllowed         ErrorCode = "MethodNotAllowed"
+	CodeTimeout                  ErrorCode = "Timeout"
+	CodeRateLimited              ErrorCode = "RateLimited"
+	CodeTooManyConnections       ErrorCode = "TooManyConnections"
+	CodeConnectionEvicted        ErrorCode = "ConnectionEvicted"
+	CodeServerBusy               ErrorCode = "ServerBusy"
+	CodeInternal                 ErrorCode = "Internal"
+)
+
+var (
+	// ErrInvalidData is returned when request data cannot be parsed or is invalid
+	ErrInvalidData = errors.New("invalid data")
+	// ErrInvalidDataType is returned when a request has an unknown data type
+	ErrInvalidDataType = errors.New("invalid data type")
+	// ErrInvalidToken is returned when the token of a user cannot be validated
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrUnauthenticated is returned when a request needs an authenticated connection
+	ErrUnauthenticated = errors.New("connection is not authenticated")
+	// ErrMethodNotAllowed is returned when an http route does not support the request method
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// ErrRateLimited is returned when a client sends requests faster than its rate limit allows
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrTooManyConnections is returned when a user or remote address has too many connections
+	ErrTooManyConnections = errors.New("too many connections")
+	// ErrConnectionEvicted is sent to a connection closed to make room for a newer one of its user
+	ErrConnectionEvicted = errors.New("connection evicted")
+	// ErrServerBusy is returned when the instance does not accept more connections
+	ErrServerBusy = errors.New("server is at capacity")
+)
+
+// RateLimitError is returned when a request exceeds a rate limit, it matches ErrRateLimited
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %v", e.RetryAfter)
+}
+
+// Is reports whether the target is ErrRateLimited
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// catalogueEntry maps an error to the code, http status and details sent to clients. The details of
+// detailed entries are the error itself, which is only set for errors whose text is written by
+// this service and describes what the client did wrong.
+type catalogueEntry struct {
+	err      error
+	code     ErrorCode
+	status   int
+	details  string
+	detailed bool
+}
+
+// catalogue lists the errors clients are told about, the first entry an error matches is used so
+// more specific errors come first
+var catalogue = []catalogueEntry{
+	{ErrInvalidData, CodeInvalidData, http.StatusBadRequest, "Invalid data", true},
+	{ErrInvalidDataType, CodeInvalidDataType, http.StatusBadRequest, "Invalid data type", true},
+	{ErrInvalidToken, CodeInvalidToken, http.StatusUnauthorized, "Could not validate token", false},
+	{ErrUnauthenticated, CodeUnauthenticated, http.StatusUnauthorized, "Connection is not authenticated", false},
+	{ErrMethodNotAllowed, CodeMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed", false},
+	{model.ErrUnknownMessageType, CodeUnknownMessageType, http.StatusBadRequest, "Unknown message type", true},
+	{model.ErrInvalidMessageBody, CodeInvalidMessageBody, http.StatusBadRequest, "Invalid message body", true},
+	{model.ErrInvalidSwapTransition, CodeInvalidSwapTransition, http.StatusConflict, "Invalid swap agreement transition", true},
+	{ErrNotParticipant, CodeNotParticipant, http.StatusForbidden, "User is not a participant of the thread", false},
+	{ErrAttachmentNotFound, CodeAttachmentNotFound, http.StatusNotFound, "Attachment not found", false},
+	{ErrAttachmentTooLarge, CodeAttachmentTooLarge, http.StatusRequestEntityTooLarge, "Attachment is too large", true},
+	{ErrAttachmentTypeNotAllowed, CodeAttachmentTypeNotAllowed, http.StatusUnsupportedMediaType, "Attachment type is not allowed", true},
+	{ErrInvalidImage, CodeInvalidImage, http.StatusBadRequest, "Could not process image", false},
+	{errorcodes.ErrNotFound, CodeNotFound, http.StatusNotFound, "Not found", false},
+	{ErrRateLimited, CodeRateLimited, http.StatusTooManyRequests, "Rate limit exceeded", false},
+	{ErrTooManyConnections, CodeTooManyConnections, http.StatusTooManyRequests, "Too many connections", false},
+	{ErrConnectionEvicted, CodeConnectionEvicted, http.StatusConflict, "Connection was replaced by a newer connection", false},
+	{ErrServerBusy, CodeServerBusy, http.StatusServiceUnavailable, "Server is at capacity", false},
+	{context.DeadlineExceeded, CodeTimeout, http.StatusGatewayTimeout, "Request timed out", false},
+}
+
+// ClientError returns the error sent to clients for err together with its http status. Errors
+// which are not in the catalogue are logged and reported as internal errors without details.
+func ClientError(ctx context.Context, err error) (model.Error, int) {
+	for _, e := range catalogue {
+		if !errors.Is(err, e.err) {
+			continue
+		}
+		details := e.details
+		if e.detailed {
+			details = err.Error()
+		}
+		metrics.Errors.WithLabelValues(string(e.code)).Inc()
+		tracing.RecordError(ctx, err, kv.String("error.code", string(e.code)))
+		clientErr := model.Error{Code: string(e.code), Details: details}
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			// Round up to the millisecond so that clients do not retry too early
+			clientErr.RetryAfter = math.Ceil(rateLimitErr.RetryAfter.Seconds()*1000) / 1000
+		}
+		return clientErr, e.status
+	}
+
+	logger.FromContext(ctx).Error("internal error", "error", err)
+	metrics.Errors.WithLabelValues(string(CodeInternal)).Inc()
+	tracing.RecordError(ctx, err, kv.String("error.code", string(CodeInternal)))
+	return model.Error{Code: string(CodeInternal), Details: "Internal error"}, http.StatusInternalServerError
+}
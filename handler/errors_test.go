@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/repository"
+)
+
+func TestClientErrorRetryAfter(t *testing.T) {
+	err := fmt.Errorf("could not handle request: %w", &RateLimitError{RetryAfter: 1234100 * time.Microsecond})
+
+	e, status := ClientError(context.Background(), err)
+	if e.Code != string(CodeRateLimited) || status != http.StatusTooManyRequests {
+		t.Fatalf("got code %v and status %v, want %v and %v", e.Code, status, CodeRateLimited, http.StatusTooManyRequests)
+	}
+	if e.RetryAfter != 1.235 {
+		t.Errorf("retry after is %v, want it rounded up to 1.235", e.RetryAfter)
+	}
+}
+
+// timeoutRepo is a repository whose queries time out
+type timeoutRepo struct {
+	repository.MessagingRepository
+}
+
+func (timeoutRepo) FindOrCreateThread(ctx context.Context, thread *model.Thread) (*model.Thread, bool, error) {
+	return nil, false, context.DeadlineExceeded
+}
+
+func (timeoutRepo) GetLastEventSeq(ctx context.Context, userID string) (int64, error) {
+	return 0, context.DeadlineExceeded
+}
+
+func TestClientErrorRepositoryTimeout(t *testing.T) {
+	ms := &messagingService{repo: timeoutRepo{}}
+	ctx := context.Background()
+
+	_, _, storeErr := ms.StoreMessage(ctx, "sender", &model.Message{ReceiverID: "receiver", MessageType: model.Text})
+	_, inboxErr := ms.GetInboxByUserID(ctx, "user", 10)
+	for _, err := range []error{storeErr, inboxErr} {
+		e, status := ClientError(ctx, err)
+		if e.Code != string(CodeTimeout) || status != http.StatusGatewayTimeout {
+			t.Errorf("error '%v' got code %v and status %v, want %v and %v", err, e.Code, status, CodeTimeout, http.StatusGatewayTimeout)
+		}
+	}
+}
@@ -1,30 +1,55 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/shohag000/test-websocket/batman/auth"
 	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
 	"github.com/shohag000/test-websocket/model"
 	"github.com/shohag000/test-websocket/repository"
+	"github.com/shohag000/test-websocket/storage"
+	"github.com/shohag000/test-websocket/tracing"
 )
 
 // MessagingService defines the services of the messagins system
 type MessagingService interface {
 	AuthenticateToken(token string) (userID string, valid bool, err error)
-	GetInboxByUserID(userID string, messageLimit int) (*model.Inbox, error)
-	StoreMessage(message *model.Message) error
+	GetInboxByUserID(ctx context.Context, userID string, messageLimit int) (*model.Inbox, error)
+	StoreMessage(ctx context.Context, senderID string, message *model.Message) (stored *model.Message, created bool, err error)
 	// CreateThread(thread *model.Thread) error
-	FindThreadByUsers(userID, otherUserID string) (*model.Thread, error)
+	FindThreadByUsers(ctx context.Context, userID, otherUserID string) (*model.Thread, error)
 	// FindThreadByThreadID(threadID string) (*model.Thread, error)
-	GetAllMessagesByThreadID(threadID string, limit, skip int64) ([]*model.Message, error)
+	GetAllMessagesByThreadID(ctx context.Context, userID string, req *model.GetMessagesInThreadRequest) ([]*model.Message, error)
+	RespondToSwapAgreement(ctx context.Context, userID string, resp *model.SwapResponse) (*model.Message, error)
+	UploadAttachment(ctx context.Context, ownerID, fileName string, r io.Reader) (*model.Attachment, error)
+	OpenAttachment(ctx context.Context, userID, attachmentID string, thumbnail bool) (*model.Attachment, io.ReadCloser, error)
+	RecordEvent(ctx context.Context, userID, sourceID string, dataType model.DataType, data interface{}) (*model.Event, error)
+	GetEventsSince(ctx context.Context, userID string, seq int64) ([]*model.Event, error)
+	RegisterDevice(ctx context.Context, userID string, device *model.Device) error
+	MuteThread(ctx context.Context, userID string, mute *model.ThreadMute) error
+	TouchUser(ctx context.Context, userID string) error
+	GetUserSettings(ctx context.Context, userID string) (*model.UserSettings, error)
+	UpdateUserSettings(ctx context.Context, userID string, settings *model.UserSettings) error
 }
 
+var (
+	// ErrNotParticipant is returned when a user acts on a thread they are not part of
+	ErrNotParticipant = errors.New("user is not a participant of the thread")
+	// ErrCatchUpTooLarge is returned when a client missed too many events to catch up on them
+	ErrCatchUpTooLarge = errors.New("too many missed events")
+)
+
 type messagingService struct {
 	repo          repository.MessagingRepository
 	authenticator auth.Authenticator
+	blobs         storage.BlobStore
+	config        config.Config
 }
 
 func (ms *messagingService) AuthenticateToken(token string) (string, bool, error) {
@@ -38,80 +63,297 @@ func (ms *messagingService) AuthenticateToken(token string) (string, bool, error
 	return u.UserID, true, nil
 }
 
-func (ms *messagingService) GetInboxByUserID(userID string, messageLimit int) (*model.Inbox, error) {
-	inbox, err := ms.repo.GetInboxByUserID(userID, int64(messageLimit))
+func (ms *messagingService) GetInboxByUserID(ctx context.Context, userID string, messageLimit int) (*model.Inbox, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.GetInboxByUserID")
+	defer span.End()
+
+	// Read the seq before the inbox, events recorded in between are delivered twice rather than missed
+	seq, err := ms.repo.GetLastEventSeq(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("could not fetch inbox: %v", err)
+		return nil, fmt.Errorf("could not fetch last event seq: %w", err)
 	}
+
+	// An incomplete inbox is returned with its flags set
+	inbox, err := ms.repo.GetInboxByUserID(ctx, userID, int64(messageLimit))
+	if err != nil && !logPartial(ctx, "inbox of user "+userID, err) {
+		return nil, fmt.Errorf("could not fetch inbox: %w", err)
+	}
+	inbox.LastSeq = seq
 	return inbox, nil
 }
 
-func (ms *messagingService) StoreMessage(message *model.Message) error {
-	// Check if thread exists, if not, create a new thread
-	thread, err := ms.FindThreadByUsers(message.SenderID, message.ReceiverID)
-	if err != nil {
+func (ms *messagingService) StoreMessage(ctx context.Context, senderID string, message *model.Message) (*model.Message, bool, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.StoreMessage")
+	defer span.End()
+
+	// The sender is the authenticated user, it is also the proposer of a swap agreement card
+	message.SenderID = senderID
+
+	// A resent message returns the message stored by the first submission
+	if message.ClientMessageID != "" {
+		stored, err := ms.repo.FindMessageByClientID(ctx, message.SenderID, message.ClientMessageID)
+		if err == nil {
+			return stored, false, nil
+		}
 		if !errors.Is(err, errorcodes.ErrNotFound) {
-			return fmt.Errorf("could not find thread: %v", err)
+			return nil, false, fmt.Errorf("could not find message: %w", err)
 		}
 	}
 
-	if thread == nil {
-		// Generate new thread id
-		tID, err := model.GenerateThreadIDHash(message.SenderID, message.ReceiverID)
-		if err != nil {
-			return fmt.Errorf("could not create thread id: %v", err)
-		}
-
-		// Create thread model
-		thread = &model.Thread{
-			ThreadID:  tID,
-			UserID1:   message.SenderID,
-			UserID2:   message.ReceiverID,
-			UpdatedAt: time.Now(),
-		}
+	// Find the thread of the users or create it if this is their first message
+	thread, _, err := ms.repo.FindOrCreateThread(ctx, &model.Thread{
+		ThreadID:  model.GenerateThreadID([]byte(ms.config.ThreadIDKey), message.SenderID, message.ReceiverID),
+		UserID1:   message.SenderID,
+		UserID2:   message.ReceiverID,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("could not find or create thread: %w", err)
+	}
 
-		// Store thread
-		err = ms.repo.StoreThread(thread)
+	// Link file attachments to the thread
+	if body, ok := message.MessageBody.(*model.FileBody); ok {
+		err = ms.attachFile(ctx, message.SenderID, thread.ThreadID, body)
 		if err != nil {
-			return fmt.Errorf("could not store thread: %v", err)
+			return nil, false, fmt.Errorf("could not attach file: %w", err)
 		}
 	}
 
 	// Store message
 	message.ThreadID = thread.ThreadID
-	err = ms.repo.StoreMessage(message)
+	err = ms.repo.StoreMessage(ctx, message)
 	if err != nil {
-		return fmt.Errorf("could not store message: %v", err)
+		if errors.Is(err, repository.ErrDuplicateMessage) {
+			// A concurrent submission stored the message first
+			stored, err := ms.repo.FindMessageByClientID(ctx, message.SenderID, message.ClientMessageID)
+			if err != nil {
+				return nil, false, fmt.Errorf("could not find message: %w", err)
+			}
+			return stored, false, nil
+		}
+		return nil, false, fmt.Errorf("could not store message: %w", err)
 	}
 
-	return nil
+	return message, true, nil
 }
 
-// func (ms *messagingService) CreateThread(thread *model.Thread) error {
+// func (ms *messagingService) CreateThread(ctx context.Context, thread *model.Thread) error {
 // 	return nil
 // }
 
-func (ms *messagingService) FindThreadByUsers(uID1, uID2 string) (*model.Thread, error) {
-	tr, err := ms.repo.FindThreadByUsers(uID1, uID2)
+func (ms *messagingService) FindThreadByUsers(ctx context.Context, uID1, uID2 string) (*model.Thread, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.FindThreadByUsers")
+	defer span.End()
+
+	tr, err := ms.repo.FindThreadByUsers(ctx, uID1, uID2)
 	if err != nil {
 		return nil, err
 	}
 	return tr, nil
 }
 
-func (ms *messagingService) GetAllMessagesByThreadID(threadID string, limit, skip int64) ([]*model.Message, error) {
-	messages, err := ms.repo.GetAllMessagesByThreadID(threadID, limit, skip)
+func (ms *messagingService) GetAllMessagesByThreadID(ctx context.Context, userID string, req *model.GetMessagesInThreadRequest) ([]*model.Message, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.GetAllMessagesByThreadID")
+	defer span.End()
+
+	thread, err := ms.repo.FindThreadByID(ctx, req.ThreadID)
 	if err != nil {
-		return nil, fmt.Errorf("could not fetch messages: %v", err)
+		if errors.Is(err, errorcodes.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not find thread: %w", err)
+	}
+
+	if userID != thread.UserID1 && userID != thread.UserID2 {
+		return nil, ErrNotParticipant
+	}
+
+	messages, err := ms.repo.GetAllMessagesByThreadID(ctx, req)
+	if err != nil && !logPartial(ctx, "messages of thread "+req.ThreadID, err) {
+		return nil, fmt.Errorf("could not fetch messages: %w", err)
 	}
 
 	return messages, nil
 }
 
+func (ms *messagingService) RespondToSwapAgreement(ctx context.Context, userID string, resp *model.SwapResponse) (*model.Message, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.RespondToSwapAgreement")
+	defer span.End()
+
+	// Find the original card in the thread
+	msg, err := ms.repo.FindSwapAgreementMessage(ctx, resp.ThreadID, resp.SwapAgreementID)
+	if err != nil {
+		if errors.Is(err, errorcodes.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not find swap agreement: %w", err)
+	}
+
+	if userID != msg.SenderID && userID != msg.ReceiverID {
+		return nil, ErrNotParticipant
+	}
+
+	// Validate the transition, the sender of the card is the proposer
+	card := msg.MessageBody.(*model.SwapAgreement)
+	err = card.CanTransition(resp.Status, userID == msg.SenderID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the card in place
+	from := card.Status
+	card.Status = resp.Status
+	card.RespondedBy = userID
+	card.UpdatedAt = time.Now()
+	err = ms.repo.UpdateSwapAgreement(ctx, msg, from)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidSwapTransition) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not update swap agreement: %w", err)
+	}
+
+	return msg, nil
+}
+
+func (ms *messagingService) RecordEvent(ctx context.Context, userID, sourceID string, dataType model.DataType, data interface{}) (*model.Event, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.RecordEvent")
+	defer span.End()
+
+	event := &model.Event{
+		UserID:    userID,
+		SourceID:  sourceID,
+		DataType:  dataType,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+
+	err := ms.repo.AppendEvent(ctx, event)
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicateEvent) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not record event: %w", err)
+	}
+
+	return event, nil
+}
+
+func (ms *messagingService) GetEventsSince(ctx context.Context, userID string, seq int64) ([]*model.Event, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.GetEventsSince")
+	defer span.End()
+
+	var events []*model.Event
+	for {
+		page, err := ms.repo.GetEventsSince(ctx, userID, seq, ms.config.CatchUpPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch events: %w", err)
+		}
+
+		events = append(events, page...)
+		if int64(len(events)) > ms.config.MaxCatchUpEvents {
+			return nil, ErrCatchUpTooLarge
+		}
+		if int64(len(page)) < ms.config.CatchUpPageSize {
+			return events, nil
+		}
+		seq = page[len(page)-1].Seq
+	}
+}
+
+func (ms *messagingService) RegisterDevice(ctx context.Context, userID string, device *model.Device) error {
+	ctx, span := tracing.Start(ctx, "MessagingService.RegisterDevice")
+	defer span.End()
+
+	device.UserID = userID
+	device.UpdatedAt = time.Now()
+
+	err := ms.repo.StoreDevice(ctx, device)
+	if err != nil {
+		return fmt.Errorf("could not store device: %w", err)
+	}
+
+	return nil
+}
+
+func (ms *messagingService) MuteThread(ctx context.Context, userID string, mute *model.ThreadMute) error {
+	ctx, span := tracing.Start(ctx, "MessagingService.MuteThread")
+	defer span.End()
+
+	thread, err := ms.repo.FindThreadByID(ctx, mute.ThreadID)
+	if err != nil {
+		if errors.Is(err, errorcodes.ErrNotFound) {
+			return err
+		}
+		return fmt.Errorf("could not find thread: %w", err)
+	}
+
+	if userID != thread.UserID1 && userID != thread.UserID2 {
+		return ErrNotParticipant
+	}
+
+	err = ms.repo.SetThreadMuted(ctx, mute.ThreadID, userID, mute.Muted)
+	if err != nil {
+		return fmt.Errorf("could not mute thread: %w", err)
+	}
+
+	return nil
+}
+
+func (ms *messagingService) TouchUser(ctx context.Context, userID string) error {
+	ctx, span := tracing.Start(ctx, "MessagingService.TouchUser")
+	defer span.End()
+
+	err := ms.repo.TouchUser(ctx, userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not update last seen: %w", err)
+	}
+	return nil
+}
+
+func (ms *messagingService) GetUserSettings(ctx context.Context, userID string) (*model.UserSettings, error) {
+	ctx, span := tracing.Start(ctx, "MessagingService.GetUserSettings")
+	defer span.End()
+
+	settings, err := ms.repo.GetUserSettings(ctx, userID)
+	if err != nil {
+		if errors.Is(err, errorcodes.ErrNotFound) {
+			return &model.UserSettings{UserID: userID}, nil
+		}
+		return nil, fmt.Errorf("could not fetch user settings: %w", err)
+	}
+	return settings, nil
+}
+
+func (ms *messagingService) UpdateUserSettings(ctx context.Context, userID string, settings *model.UserSettings) error {
+	ctx, span := tracing.Start(ctx, "MessagingService.UpdateUserSettings")
+	defer span.End()
+
+	settings.UserID = userID
+	err := ms.repo.UpdateUserSettings(ctx, settings)
+	if err != nil {
+		return fmt.Errorf("could not update user settings: %w", err)
+	}
+	return nil
+}
+
+// logPartial logs the documents which could not be loaded if err is a partial error, and reports
+// whether it is one
+func logPartial(ctx context.Context, what string, err error) bool {
+	var partial *repository.PartialError
+	if !errors.As(err, &partial) {
+		return false
+	}
+	logger.FromContext(ctx).Warn(what+" is incomplete", "documentIds", partial.DocumentIDs(), "error", err)
+	return true
+}
+
 // NewService  returns a new messaging service
-func NewService(repo repository.MessagingRepository, authenticator auth.Authenticator) MessagingService {
+func NewService(repo repository.MessagingRepository, authenticator auth.Authenticator, blobs storage.BlobStore) MessagingService {
 	return &messagingService{
 		repo:          repo,
 		authenticator: authenticator,
+		blobs:         blobs,
+		config:        config.New(),
 	}
 }
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/tracing"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// multipartOverhead is the allowance for multipart headers on top of the attachment size limit
+const multipartOverhead = 64 << 10
+
+type attachmentHandler struct {
+	service MessagingService
+	config  config.Config
+}
+
+// NewAttachmentHandler returns the http handler for uploading attachments with
+// POST {route}, downloading them with GET {route}{attachmentId} and downloading
+// image thumbnails with GET {route}{attachmentId}/thumbnail
+func NewAttachmentHandler(service MessagingService) http.Handler {
+	return &attachmentHandler{
+		service: service,
+		config:  config.New(),
+	}
+}
+
+func (ah *attachmentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Authenticate the user
+	log := logger.Default().With("requestId", logger.NewID(), "method", r.Method, "path", r.URL.Path)
+	userID, ok, err := ah.service.AuthenticateToken(requestToken(r))
+	if err != nil || !ok {
+		writeError(w, r, ErrInvalidToken)
+		return
+	}
+	ctx, span := tracing.Start(tracing.WithTraceParent(r.Context(), r.Header.Get("traceparent")), "http.attachments",
+		kv.String("http.method", r.Method),
+		kv.String("enduser.id", userID),
+	)
+	defer span.End()
+	r = r.WithContext(logger.NewContext(ctx, log.With("userId", userID, "traceId", span.SpanContext().TraceID.String())))
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, ah.config.AttachmentDownloadRoute), "/")
+	switch {
+	case len(path) > 2 || (len(path) == 2 && path[1] != "thumbnail"):
+		writeError(w, r, errorcodes.ErrNotFound)
+	case r.Method == http.MethodPost && path[0] == "" && len(path) == 1:
+		ah.upload(w, r, userID)
+	case r.Method == http.MethodGet && path[0] != "":
+		ah.download(w, r, userID, path[0], len(path) == 2)
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+func (ah *attachmentHandler) upload(w http.ResponseWriter, r *http.Request, userID string) {
+	r.Body = http.MaxBytesReader(w, r.Body, ah.config.MaxAttachmentSize+multipartOverhead)
+
+	// Stream the "file" part of the multipart form
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: expected a multipart form", ErrInvalidData))
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			writeError(w, r, fmt.Errorf("%w: missing 'file' field", ErrInvalidData))
+			return
+		}
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: could not read multipart form", ErrInvalidData))
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		attachment, err := ah.service.UploadAttachment(r.Context(), userID, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, attachment)
+		return
+	}
+}
+
+func (ah *attachmentHandler) download(w http.ResponseWriter, r *http.Request, userID, attachmentID string, thumbnail bool) {
+	attachment, content, err := ah.service.OpenAttachment(r.Context(), userID, attachmentID, thumbnail)
+	if err != nil {
+		// Do not reveal attachments the user cannot access
+		if errors.Is(err, ErrNotParticipant) {
+			err = errorcodes.ErrNotFound
+		}
+		writeError(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	contentType, size := attachment.ContentType, attachment.Size
+	if thumbnail {
+		contentType, size = attachment.Thumbnail.ContentType, attachment.Thumbnail.Size
+	}
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, attachment.FileName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	io.Copy(w, content)
+}
+
+// requestToken returns the bearer token of the request, the token query parameter is accepted
+// for clients that cannot set headers such as image tags
+func requestToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the client error of err with its http status
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, status := ClientError(r.Context(), err)
+	writeJSON(w, status, e)
+}
@@ -0,0 +1,135 @@
+// Package health serves the liveness and readiness endpoints of the instance
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+)
+
+// ErrDraining is reported by the readiness check while the instance shuts down
+var ErrDraining = errors.New("instance is draining")
+
+// Check returns an error if the checked component is unhealthy
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single check
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the response of a health endpoint, the status is "ok" if all checks passed
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the liveness checks, which tell whether the instance has to be restarted, and the
+// readiness checks, which tell whether it can take traffic. Readiness includes the liveness
+// checks and fails while the instance is draining.
+type Checker struct {
+	timeout   time.Duration
+	liveness  []namedCheck
+	readiness []namedCheck
+	draining  int32
+}
+
+// New returns a checker without checks
+func New(cfg config.Config) *Checker {
+	return &Checker{timeout: cfg.HealthCheckTimeout}
+}
+
+// AddLiveness adds a check to both endpoints
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.liveness = append(c.liveness, namedCheck{name, check})
+}
+
+// AddReadiness adds a check to the readiness endpoint
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.readiness = append(c.readiness, namedCheck{name, check})
+}
+
+// Drain marks the instance as draining, readiness fails from then on
+func (c *Checker) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+// Draining reports whether the instance is draining
+func (c *Checker) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// LivenessHandler returns the handler of the liveness endpoint
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, c.liveness)
+	})
+}
+
+// ReadinessHandler returns the handler of the readiness endpoint
+func (c *Checker) ReadinessHandler() http.Handler {
+	checks := append([]namedCheck{{"draining", func(context.Context) error {
+		if c.Draining() {
+			return ErrDraining
+		}
+		return nil
+	}}}, c.liveness...)
+	checks = append(checks, c.readiness...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, checks)
+	})
+}
+
+// serve runs the checks concurrently and writes their report, with status 503 if any failed
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, checks []namedCheck) {
+	ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+	defer cancel()
+
+	report := Report{Status: "ok", Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := nc.check(ctx)
+			result := Result{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[nc.name] = result
+			if err != nil {
+				report.Status = "unavailable"
+			}
+		}(nc)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
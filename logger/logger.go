@@ -0,0 +1,193 @@
+// Package logger writes leveled log lines as json objects with the fields of the connection and
+// request they belong to
+package logger
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Log levels
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel returns the level with the name, unknown names are the info level
+func ParseLevel(name string) Level {
+	switch strings.ToLower(name) {
+	case "debug":
+		return Debug
+	case "warn", "warning":
+		return Warn
+	case "error":
+		return Error
+	}
+	return Info
+}
+
+// output is the writer shared by a logger and the loggers derived from it
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Logger writes log lines of its level and above, each line holds the fields of the logger
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+}
+
+// New returns a logger which writes to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w}, level: level}
+}
+
+// With returns a logger which adds the key value pairs to every line
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// Debug writes a debug line with the key value pairs
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(Debug, msg, keyValues)
+}
+
+// Info writes an info line with the key value pairs
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(Info, msg, keyValues)
+}
+
+// Warn writes a warning line with the key value pairs
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(Warn, msg, keyValues)
+}
+
+// Error writes an error line with the key value pairs
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(Error, msg, keyValues)
+}
+
+// Fatal writes an error line with the key value pairs and exits
+func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
+	l.log(Error, msg, keyValues)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keyValues []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeField(&buf, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeField(&buf, "level", level.String())
+	buf.WriteByte(',')
+	writeField(&buf, "msg", msg)
+	for _, kv := range [][]interface{}{l.fields, keyValues} {
+		for i := 0; i < len(kv); i += 2 {
+			var v interface{}
+			if i+1 < len(kv) {
+				v = kv[i+1]
+			}
+			buf.WriteByte(',')
+			writeField(&buf, fmt.Sprint(kv[i]), v)
+		}
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+// writeField writes the json encoded key and value, errors and stringers are written as strings
+func writeField(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(b)
+}
+
+var std atomic.Value
+
+func init() {
+	std.Store(New(os.Stderr, Info))
+}
+
+// Default returns the logger used without a logger in the context
+func Default() *Logger {
+	return std.Load().(*Logger)
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	std.Store(l)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context which carries the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of the context or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
+
+// NewID returns a random id for correlating the log lines of a connection or request
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/shohag000/test-websocket/batman/auth"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/digest"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/health"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/metrics"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/notification"
+	"github.com/shohag000/test-websocket/outbox"
+	"github.com/shohag000/test-websocket/repository"
+	"github.com/shohag000/test-websocket/storage"
+	"github.com/shohag000/test-websocket/tracing"
+	"github.com/shohag000/test-websocket/webhook"
 	"github.com/shohag000/test-websocket/ws"
 )
 
 var addr = flag.String("addr", ":10000", "http service address")
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.URL)
+	logger.Default().Debug("serving home", "url", r.URL.String())
 	if r.URL.Path != "/" {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -25,14 +44,159 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	flag.Parse()
+	cfg := config.New()
+	logger.SetDefault(logger.New(os.Stderr, logger.ParseLevel(cfg.LogLevel)))
+	log := logger.Default()
+	stopTracing, err := tracing.Setup(cfg)
+	if err != nil {
+		log.Fatal("could not set up tracing", "error", err)
+	}
+	if cfg.ThreadIDKey == "" {
+		log.Fatal("THREAD_ID_KEY is not set, thread ids could be derived from user ids")
+	}
+
+	// Get db client
+	dbClient, err := repository.GetDBClient(cfg)
+	if err != nil {
+		log.Fatal("could not connect to the database", "error", err)
+	}
+
+	// Run the migrate command instead of the server
+	if flag.Arg(0) == "migrate" {
+		err = runMigrate(dbClient, cfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatal("could not migrate", "error", err)
+		}
+		return
+	}
+
+	err = migrateOnStart(dbClient, cfg)
+	if err != nil {
+		log.Fatal("could not migrate", "error", err)
+	}
+
+	// Get blob store for attachments
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		log.Fatal("could not create the blob store", "error", err)
+	}
+
+	// Get repository
+	repo := repository.NewMongoRepository(dbClient)
+
+	service := handler.NewService(repo, auth.New(), blobs)
+
+	// The repository writes domain events to the outbox, the relay publishes them on the bus and
+	// side effects subscribe to them
+	bus := eventbus.New()
+
 	hub := ws.NewHub()
+	bus.SubscribeAll(ws.FanOut(hub, service))
+
+	// Send push notifications with the configured providers
+	providers := map[model.Platform]notification.Provider{}
+	if cfg.FCM.CredentialsFile != "" {
+		fcm, err := notification.NewFCMProvider(cfg.FCM)
+		if err != nil {
+			log.Fatal("could not create the FCM provider", "error", err)
+		}
+		providers[model.Android] = fcm
+	}
+	if cfg.APNs.KeyFile != "" {
+		apns, err := notification.NewAPNsProvider(cfg.APNs)
+		if err != nil {
+			log.Fatal("could not create the APNs provider", "error", err)
+		}
+		providers[model.IOS] = apns
+	}
+	// Background work stops in order on shutdown, the relay before the subscribers it publishes to
+	relay := outbox.NewRelay(repo, bus, cfg)
+	stops := []shutdownStep{{"outbox relay", relay.Stop}}
+	if len(providers) > 0 {
+		dispatcher := notification.NewDispatcher(repo, hub, providers, cfg)
+		bus.Subscribe(model.EventMessageStored, dispatcher.HandleEvent)
+		stops = append(stops, shutdownStep{"push notifications", dispatcher.Shutdown})
+	}
+
+	// Publish messaging events to the configured webhooks
+	if len(cfg.Webhooks) > 0 {
+		webhooks := webhook.NewDispatcher(repo, cfg)
+		bus.SubscribeAll(webhooks.HandleEvent)
+		stops = append(stops, shutdownStep{"webhooks", webhooks.Shutdown})
+	}
+
+	go relay.Run()
+
 	go hub.Run()
+
+	// Email digests of unread messages
+	if cfg.SMTP.Host != "" && cfg.SMTP.From != "" {
+		go digest.NewJob(repo, digest.NewSMTPMailer(cfg.SMTP), cfg).Run()
+	}
+
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		ws.ServeWs(hub, w, r)
+		ws.ServeWs(hub, service, w, r)
 	})
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	http.Handle(cfg.AttachmentDownloadRoute, handler.NewAttachmentHandler(service))
+	http.Handle("/metrics", metrics.Handler())
+	if cfg.AdminToken != "" {
+		http.Handle(cfg.AdminRoute, ws.NewAdminHandler(hub, cfg))
+	}
+
+	// The instance is alive while the hub runs, and ready while it can also reach the database
+	checker := health.New(cfg)
+	checker.AddLiveness("hub", hub.Ping)
+	checker.AddReadiness("database", repo.Ping)
+	http.Handle("/healthz", checker.LivenessHandler())
+	http.Handle("/readyz", checker.ReadinessHandler())
+
+	// The server stops accepting connections before the websocket connections, which it does not
+	// track, are closed
+	server := &http.Server{Addr: *addr}
+	stops = append([]shutdownStep{
+		{"http server", server.Shutdown},
+		{"websocket connections", hub.Shutdown},
+	}, stops...)
+	drained := make(chan struct{})
+	go func() {
+		drainOnSignal(checker, cfg, stops)
+		close(drained)
+	}()
+
+	log.Info("listening", "addr", *addr)
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("could not serve http", "error", err)
+	}
+	<-drained
+	stopTracing()
+}
+
+// shutdownStep stops a part of the server within the deadline of the context
+type shutdownStep struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// drainOnSignal reports the instance as not ready on SIGINT or SIGTERM, so that it is taken out of
+// the load balancer before the server stops accepting connections, and then runs the shutdown
+// steps in order, each within the request timeout
+func drainOnSignal(checker *health.Checker, cfg config.Config, steps []shutdownStep) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	logger.Default().Info("draining", "signal", sig.String(), "delay", cfg.ShutdownDelay)
+	checker.Drain()
+	time.Sleep(cfg.ShutdownDelay)
+
+	for _, step := range steps {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		err := step.stop(ctx)
+		cancel()
+		if err != nil {
+			logger.Default().Error("could not shut down "+step.name, "error", err)
+		}
 	}
 }
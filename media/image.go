@@ -0,0 +1,204 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// Register the gif decoder
+	_ "image/gif"
+)
+
+// ErrImageTooLarge is returned when the image has more pixels than allowed
+var ErrImageTooLarge = errors.New("image dimensions are too large")
+
+// Image is the result of processing an uploaded image
+type Image struct {
+	// Content is the image without exif and text metadata
+	Content     []byte
+	ContentType string
+	Width       int
+	Height      int
+
+	Thumbnail            []byte
+	ThumbnailContentType string
+	ThumbnailWidth       int
+	ThumbnailHeight      int
+}
+
+// IsImage reports whether images of the content type can be processed
+func IsImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// ProcessImage removes the metadata of the image, reads its dimensions and generates a thumbnail
+// which fits into a thumbSize square. Images with more than maxPixels pixels are rejected before
+// they are decoded.
+func ProcessImage(data []byte, contentType string, thumbSize, maxPixels int) (*Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image config: %v", err)
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+
+	result := &Image{ContentType: contentType}
+	thumbType := "image/png"
+	switch contentType {
+	case "image/jpeg":
+		thumbType = "image/jpeg"
+		orientation := jpegOrientation(data)
+		if orientation == 1 {
+			result.Content, err = stripJPEGMetadata(data)
+			break
+		}
+		// Without exif the orientation would be lost, so apply it to the pixels instead
+		src = orient(toRGBA(src), orientation)
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, src, &jpeg.Options{Quality: 90})
+		result.Content = buf.Bytes()
+	case "image/png":
+		result.Content, err = stripPNGMetadata(data)
+	case "image/gif":
+		// Gif has no exif metadata, keep any animation frames as they are
+		result.Content = data
+	default:
+		return nil, fmt.Errorf("unsupported image type '%s'", contentType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not strip image metadata: %v", err)
+	}
+
+	bounds := src.Bounds()
+	result.Width = bounds.Dx()
+	result.Height = bounds.Dy()
+
+	// Generate thumbnail
+	thumb := resize(toRGBA(src), thumbSize)
+	var buf bytes.Buffer
+	if thumbType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode thumbnail: %v", err)
+	}
+	result.Thumbnail = buf.Bytes()
+	result.ThumbnailContentType = thumbType
+	result.ThumbnailWidth = thumb.Bounds().Dx()
+	result.ThumbnailHeight = thumb.Bounds().Dy()
+
+	return result, nil
+}
+
+// toRGBA converts the image to RGBA with its origin at 0,0
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, src, b.Min, draw.Src)
+	return dst
+}
+
+// orient transforms the image according to the exif orientation
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// resize scales the image down to fit into a size square by averaging the covered pixels,
+// images which already fit are returned as they are
+func resize(src *image.RGBA, size int) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*w/dw, (x+1)*w/dw
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					i := src.PixOffset(sx, sy)
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,121 @@
+// Package metrics defines the prometheus metrics of the messaging service
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "messaging"
+
+var (
+	// Connections is the number of open websocket connections
+	Connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_connections",
+		Help:      "Number of open websocket connections.",
+	})
+
+	// AuthenticatedConnections is the number of websocket connections with an authenticated user
+	AuthenticatedConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_authenticated_connections",
+		Help:      "Number of websocket connections with an authenticated user.",
+	})
+
+	// InboundFrames counts the frames received from clients by data type
+	InboundFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_inbound_frames_total",
+		Help:      "Frames received from clients by data type.",
+	}, []string{"data_type"})
+
+	// OutboundFrames counts the frames sent to clients by data type
+	OutboundFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_outbound_frames_total",
+		Help:      "Frames sent to clients by data type.",
+	}, []string{"data_type"})
+
+	// FrameSize observes the size of the frames received from and sent to clients
+	FrameSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ws_frame_size_bytes",
+		Help:      "Size of websocket frames by direction.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 7),
+	}, []string{"direction"})
+
+	// DroppedClients counts the connections dropped because their send buffer was full
+	DroppedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_dropped_clients_total",
+		Help:      "Connections dropped because they did not keep up with their messages.",
+	})
+
+	// ConnectionRejections counts the connections rejected by a connection limit by the instance,
+	// ip or user limit which rejected them
+	ConnectionRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_connection_rejections_total",
+		Help:      "Connections rejected by a connection limit by limit.",
+	}, []string{"limit"})
+
+	// ConnectionEvictions counts the connections closed to make room for a newer connection of
+	// their user
+	ConnectionEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_connection_evictions_total",
+		Help:      "Connections closed to make room for a newer connection of their user.",
+	})
+
+	// RateLimited counts the requests rejected by a rate limit by data type and by the connection
+	// or user scope of the limit
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_rate_limited_total",
+		Help:      "Requests rejected by a rate limit by data type and scope.",
+	}, []string{"data_type", "scope"})
+
+	// RateLimitDisconnects counts the connections closed because they kept exceeding a rate limit
+	RateLimitDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_rate_limit_disconnects_total",
+		Help:      "Connections closed because they kept exceeding a rate limit.",
+	})
+
+	// Errors counts the errors sent to clients by error code
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Errors sent to clients by error code.",
+	}, []string{"code"})
+
+	// RepositoryDuration observes the latency of repository calls by method
+	RepositoryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "repository_duration_seconds",
+		Help:      "Latency of repository calls by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// CorruptDocuments counts the documents which could not be decoded by collection
+	CorruptDocuments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "corrupt_documents_total",
+		Help:      "Documents which could not be decoded by collection.",
+	}, []string{"collection"})
+)
+
+// ObserveRepository records the latency of a repository call which started at start
+func ObserveRepository(method string, start time.Time) {
+	RepositoryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// Handler returns the http handler which serves the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
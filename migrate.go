@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/migration"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// runMigrate runs the migrate command, "migrate" applies the pending migrations and
+// "migrate status" lists the applied and pending migrations
+func runMigrate(dbClient *mongo.Client, cfg config.Config, args []string) error {
+	migrator := migration.New(dbClient.Database(cfg.Database), cfg)
+	ctx := context.Background()
+
+	if len(args) == 0 {
+		return migrator.Up(ctx)
+	}
+	if args[0] != "status" {
+		return fmt.Errorf("unknown migrate command '%s'", args[0])
+	}
+
+	applied, err := migrator.Applied(ctx)
+	if err != nil {
+		return err
+	}
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range applied {
+		fmt.Printf("applied  %3d  %s  (%s)\n", r.Version, r.Description, r.AppliedAt.Format("2006-01-02 15:04:05"))
+	}
+	for _, m := range pending {
+		fmt.Printf("pending  %3d  %s\n", m.Version, m.Description)
+	}
+	return nil
+}
+
+// migrateOnStart applies the pending migrations if configured, otherwise it warns about them
+func migrateOnStart(dbClient *mongo.Client, cfg config.Config) error {
+	migrator := migration.New(dbClient.Database(cfg.Database), cfg)
+	ctx := context.Background()
+
+	if cfg.MigrateOnStart {
+		return migrator.Up(ctx)
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		logger.Default().Warn("migrations are pending, apply them with the migrate command", "pending", len(pending))
+	}
+	return nil
+}
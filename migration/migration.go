@@ -0,0 +1,115 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is a versioned change of the collections. Up must be idempotent, a migration which
+// fails halfway is run again from the start, and instances starting at the same time may run it
+// concurrently.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database, cfg config.Config) error
+}
+
+// Record is the entry of an applied migration in the migration collection
+type Record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Migrator applies the registered migrations which are not recorded yet
+type Migrator struct {
+	db         *mongo.Database
+	config     config.Config
+	migrations []Migration
+}
+
+// Applied returns the records of the applied migrations ordered by version
+func (m *Migrator) Applied(ctx context.Context) ([]*Record, error) {
+	collection := m.db.Collection(m.config.MigrationColl)
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var records []*Record
+	err = cur.All(ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Pending returns the migrations which are not applied yet ordered by version
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	records, err := m.Applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch applied migrations: %v", err)
+	}
+	applied := make(map[int]bool, len(records))
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+
+	var pending []Migration
+	for _, mg := range m.migrations {
+		if !applied[mg.Version] {
+			pending = append(pending, mg)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies the pending migrations in order and stops at the first one which fails
+func (m *Migrator) Up(ctx context.Context) error {
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	collection := m.db.Collection(m.config.MigrationColl)
+	for _, mg := range pending {
+		logger.Default().Info("applying migration", "version", mg.Version, "description", mg.Description)
+		err := mg.Up(ctx, m.db, m.config)
+		if err != nil {
+			return fmt.Errorf("could not apply migration %d: %v", mg.Version, err)
+		}
+
+		_, err = collection.InsertOne(ctx, Record{
+			Version:     mg.Version,
+			Description: mg.Description,
+			AppliedAt:   time.Now(),
+		})
+		// A concurrent instance may have recorded the migration first
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("could not record migration %d: %v", mg.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// New returns a migrator of the database with the registered migrations
+func New(db *mongo.Database, cfg config.Config) *Migrator {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	return &Migrator{
+		db:         db,
+		config:     cfg,
+		migrations: sorted,
+	}
+}
@@ -0,0 +1,181 @@
+package migration
+
+import (
+	"context"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrations is the registry of migrations, append new migrations with the next version and
+// never change one which has been released
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create message indexes",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+			return createIndexes(ctx, db.Collection(cfg.MessageColl),
+				// A client message id is unique per sender
+				mongo.IndexModel{
+					Keys: keys("senderId", "clientMessageId"),
+					Options: options.Index().
+						SetName("senderId_clientMessageId").
+						SetUnique(true).
+						SetPartialFilterExpression(bson.M{"clientMessageId": bson.M{"$type": "string"}}),
+				},
+				// Messages of a thread are paged by seq
+				mongo.IndexModel{
+					Keys:    keys("threadId", "seq", "createdAt"),
+					Options: options.Index().SetName("threadId_seq_createdAt"),
+				},
+				// Swap agreement cards are found by their id
+				mongo.IndexModel{
+					Keys: keys("threadId", "messageBody.swapAgreementId"),
+					Options: options.Index().
+						SetName("threadId_swapAgreementId").
+						SetPartialFilterExpression(bson.M{"messageType": model.SwapAgreementCard}),
+				},
+				// Unread messages of the email digest
+				mongo.IndexModel{
+					Keys:    keys("receiverId", "createdAt"),
+					Options: options.Index().SetName("receiverId_createdAt"),
+				},
+			)
+		},
+	},
+	{
+		Version:     2,
+		Description: "create thread indexes",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+			// Threads duplicated before the unique index existed would fail to index, merging
+			// them finds nothing to do on databases which already have the index
+			err := mergeDuplicateThreads(ctx, db, cfg)
+			if err != nil {
+				return err
+			}
+
+			return createIndexes(ctx, db.Collection(cfg.ThreadColl),
+				// A thread id is unique, concurrent first messages of two users create a single thread
+				mongo.IndexModel{
+					Keys:    keys("threadId"),
+					Options: options.Index().SetName("threadId").SetUnique(true),
+				},
+				// Threads are looked up by their users
+				mongo.IndexModel{
+					Keys:    keys("userId1", "userId2"),
+					Options: options.Index().SetName("userId1_userId2"),
+				},
+				mongo.IndexModel{
+					Keys:    keys("userId2"),
+					Options: options.Index().SetName("userId2"),
+				},
+			)
+		},
+	},
+	{
+		Version:     3,
+		Description: "create sync log indexes",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+			return createIndexes(ctx, db.Collection(cfg.EventColl),
+				mongo.IndexModel{
+					Keys:    keys("userId", "seq"),
+					Options: options.Index().SetName("userId_seq").SetUnique(true),
+				},
+				// An outbox entry is recorded at most once in each user's sync log
+				mongo.IndexModel{
+					Keys: keys("userId", "sourceId"),
+					Options: options.Index().
+						SetName("userId_sourceId").
+						SetUnique(true).
+						SetPartialFilterExpression(bson.M{"sourceId": bson.M{"$type": "string"}}),
+				},
+			)
+		},
+	},
+	{
+		Version:     4,
+		Description: "create outbox indexes",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+			return createIndexes(ctx, db.Collection(cfg.OutboxColl),
+				// Pending entries are claimed in order
+				mongo.IndexModel{
+					Keys:    keys("publishedAt", "lockedUntil", "createdAt"),
+					Options: options.Index().SetName("pending"),
+				},
+				// Published entries expire
+				mongo.IndexModel{
+					Keys: keys("publishedAt"),
+					Options: options.Index().
+						SetName("publishedAt_ttl").
+						SetExpireAfterSeconds(int32(cfg.OutboxRetention / time.Second)),
+				},
+			)
+		},
+	},
+	{
+		Version:     5,
+		Description: "create attachment, device and user indexes",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+			err := createIndexes(ctx, db.Collection(cfg.AttachmentColl),
+				mongo.IndexModel{
+					Keys:    keys("attachmentId"),
+					Options: options.Index().SetName("attachmentId").SetUnique(true),
+				},
+			)
+			if err != nil {
+				return err
+			}
+
+			err = createIndexes(ctx, db.Collection(cfg.DeviceColl),
+				mongo.IndexModel{
+					Keys:    keys("token"),
+					Options: options.Index().SetName("token").SetUnique(true),
+				},
+				mongo.IndexModel{
+					Keys:    keys("userId"),
+					Options: options.Index().SetName("userId"),
+				},
+			)
+			if err != nil {
+				return err
+			}
+
+			return createIndexes(ctx, db.Collection(cfg.UserColl),
+				mongo.IndexModel{
+					Keys:    keys("userId"),
+					Options: options.Index().SetName("userId").SetUnique(true),
+				},
+				// Candidates of the email digest
+				mongo.IndexModel{
+					Keys:    keys("lastSeenAt"),
+					Options: options.Index().SetName("lastSeenAt"),
+				},
+			)
+		},
+	},
+	{
+		Version:     6,
+		Description: "rekey threads with legacy ids",
+		Up:          rekeyLegacyThreads,
+	},
+}
+
+// createIndexes creates the indexes, existing indexes with the same definition are left as they are
+func createIndexes(ctx context.Context, collection *mongo.Collection, models ...mongo.IndexModel) error {
+	_, err := collection.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// keys returns ascending index keys of the fields
+func keys(fields ...string) bson.D {
+	d := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		d = append(d, primitive.E{Key: f, Value: 1})
+	}
+	return d
+}
@@ -0,0 +1,342 @@
+package migration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// threadDocument is a thread with its document id
+type threadDocument struct {
+	ID           interface{} `bson:"_id"`
+	model.Thread `bson:",inline"`
+}
+
+// mergeDuplicateThreads merges the thread documents which share a thread id, which concurrent
+// first messages created before the unique thread id index existed
+func mergeDuplicateThreads(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+	cur, err := db.Collection(cfg.ThreadColl).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$threadId", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return fmt.Errorf("could not find duplicate threads: %v", err)
+	}
+	var duplicates []struct {
+		ThreadID string `bson:"_id"`
+	}
+	err = cur.All(ctx, &duplicates)
+	if err != nil {
+		return fmt.Errorf("could not find duplicate threads: %v", err)
+	}
+
+	for _, d := range duplicates {
+		err = mergeThread(ctx, db, cfg, d.ThreadID)
+		if err != nil {
+			return fmt.Errorf("could not merge thread %s: %v", d.ThreadID, err)
+		}
+	}
+	return nil
+}
+
+// mergeThread keeps the oldest document of the thread with the highest seq and the mutes of all
+// of them, and deletes the others. Messages reference the thread by id so they stay in place,
+// they are numbered again in the order they were created if different documents gave out a seq twice.
+func mergeThread(ctx context.Context, db *mongo.Database, cfg config.Config, threadID string) error {
+	threads := db.Collection(cfg.ThreadColl)
+	cur, err := threads.Find(ctx, bson.M{"threadId": threadID}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var docs []*threadDocument
+	err = cur.All(ctx, &docs)
+	if err != nil {
+		return err
+	}
+	if len(docs) < 2 {
+		return nil
+	}
+
+	var lastSeq int64
+	var updatedAt time.Time
+	mutedBy := []string{}
+	ids := make([]interface{}, 0, len(docs)-1)
+	for i, d := range docs {
+		if d.LastSeq > lastSeq {
+			lastSeq = d.LastSeq
+		}
+		if d.UpdatedAt.After(updatedAt) {
+			updatedAt = d.UpdatedAt
+		}
+		mutedBy = append(mutedBy, d.MutedBy...)
+		if i > 0 {
+			ids = append(ids, d.ID)
+		}
+	}
+
+	seq, err := renumberMessages(ctx, db.Collection(cfg.MessageColl), threadID)
+	if err != nil {
+		return fmt.Errorf("could not renumber messages: %v", err)
+	}
+	if seq > lastSeq {
+		lastSeq = seq
+	}
+
+	_, err = threads.UpdateOne(ctx, bson.M{"_id": docs[0].ID}, bson.M{
+		"$set":      bson.M{"lastSeq": lastSeq, "updatedAt": updatedAt},
+		"$addToSet": bson.M{"mutedBy": bson.M{"$each": mutedBy}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = threads.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+
+	logger.Default().Warn("merged duplicate thread documents", "threadId", threadID, "duplicates", len(ids))
+	return nil
+}
+
+// seqMessage is the id, seq and creation time of a message
+type seqMessage struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Seq       int64              `bson:"seq"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+// renumberMessages numbers the messages of the thread again in the order they were created if some
+// of them share a seq, and returns the highest seq. Messages stored before seqs were introduced
+// keep seq 0.
+func renumberMessages(ctx context.Context, messages *mongo.Collection, threadID string) (int64, error) {
+	cur, err := messages.Find(ctx,
+		bson.M{"threadId": threadID, "seq": bson.M{"$gt": 0}},
+		options.Find().SetProjection(bson.M{"_id": 1, "seq": 1, "createdAt": 1}),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var msgs []*seqMessage
+	err = cur.All(ctx, &msgs)
+	if err != nil {
+		return 0, err
+	}
+
+	changed, lastSeq := renumber(msgs)
+	for _, m := range changed {
+		_, err = messages.UpdateOne(ctx, bson.M{"_id": m.ID}, bson.M{"$set": bson.M{"seq": m.Seq}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return lastSeq, nil
+}
+
+// renumber numbers the messages from 1 in the order of their creation time and id if some of them
+// share a seq, and returns those whose seq changed and the highest seq. The seqs of merged threads
+// and of messages moved into a thread overlap, ordering them by seq would interleave the threads.
+func renumber(msgs []*seqMessage) ([]*seqMessage, int64) {
+	var lastSeq int64
+	seqs := make(map[int64]bool, len(msgs))
+	duplicate := false
+	for _, m := range msgs {
+		duplicate = duplicate || seqs[m.Seq]
+		seqs[m.Seq] = true
+		if m.Seq > lastSeq {
+			lastSeq = m.Seq
+		}
+	}
+	if !duplicate {
+		return nil, lastSeq
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		if !msgs[i].CreatedAt.Equal(msgs[j].CreatedAt) {
+			return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+		}
+		return bytes.Compare(msgs[i].ID[:], msgs[j].ID[:]) < 0
+	})
+	var changed []*seqMessage
+	for i, m := range msgs {
+		if m.Seq != int64(i+1) {
+			m.Seq = int64(i + 1)
+			changed = append(changed, m)
+		}
+	}
+	return changed, int64(len(msgs))
+}
+
+// keyedThreadID matches the thread ids of the keyed hash scheme
+var keyedThreadID = primitive.Regex{Pattern: "^[0-9a-f]{64}$"}
+
+// rekeyLegacyThreads gives the threads of earlier id schemes the keyed id of their users. The
+// messages of user pairs whose legacy ids collided are moved to a thread of their own.
+func rekeyLegacyThreads(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+	if cfg.ThreadIDKey == "" {
+		return errors.New("THREAD_ID_KEY is not set")
+	}
+
+	cur, err := db.Collection(cfg.ThreadColl).Find(ctx, bson.M{"threadId": bson.M{"$not": keyedThreadID}})
+	if err != nil {
+		return fmt.Errorf("could not find legacy threads: %v", err)
+	}
+	var docs []*threadDocument
+	err = cur.All(ctx, &docs)
+	if err != nil {
+		return fmt.Errorf("could not find legacy threads: %v", err)
+	}
+
+	for _, d := range docs {
+		err = rekeyThread(ctx, db, cfg, d)
+		if err != nil {
+			return fmt.Errorf("could not rekey thread %s: %v", d.ThreadID, err)
+		}
+	}
+	return nil
+}
+
+// rekeyThread moves the messages and attachments of each user pair of the legacy thread to the
+// keyed thread of the pair, and deletes the legacy thread
+func rekeyThread(ctx context.Context, db *mongo.Database, cfg config.Config, legacy *threadDocument) error {
+	pairs, err := messagePairs(ctx, db.Collection(cfg.MessageColl), legacy.ThreadID)
+	if err != nil {
+		return fmt.Errorf("could not find users of messages: %v", err)
+	}
+	own := newPair(legacy.UserID1, legacy.UserID2)
+	pairs[own] = true
+
+	for p := range pairs {
+		thread := &model.Thread{
+			ThreadID:  model.GenerateThreadID([]byte(cfg.ThreadIDKey), p[0], p[1]),
+			UserID1:   p[0],
+			UserID2:   p[1],
+			UpdatedAt: legacy.UpdatedAt,
+		}
+		if p == own {
+			thread.UserID1, thread.UserID2 = legacy.UserID1, legacy.UserID2
+			thread.LastSeq = legacy.LastSeq
+			thread.MutedBy = legacy.MutedBy
+		}
+
+		err = moveMessages(ctx, db, cfg, legacy.ThreadID, thread)
+		if err != nil {
+			return err
+		}
+		if p != own {
+			logger.Default().Warn("split user pair out of collided thread", "threadId", legacy.ThreadID, "newThreadId", thread.ThreadID)
+		}
+	}
+
+	_, err = db.Collection(cfg.ThreadColl).DeleteOne(ctx, bson.M{"_id": legacy.ID})
+	return err
+}
+
+// moveMessages moves the messages of the users of the thread, and the attachments shared by them,
+// from the legacy thread to the thread, which is created unless it exists
+func moveMessages(ctx context.Context, db *mongo.Database, cfg config.Config, legacyID string, thread *model.Thread) error {
+	messages := db.Collection(cfg.MessageColl)
+	_, err := messages.UpdateMany(ctx,
+		bson.M{
+			"threadId": legacyID,
+			"$or": []interface{}{
+				bson.M{"senderId": thread.UserID1, "receiverId": thread.UserID2},
+				bson.M{"senderId": thread.UserID2, "receiverId": thread.UserID1},
+			},
+		},
+		bson.M{"$set": bson.M{"threadId": thread.ThreadID}},
+	)
+	if err != nil {
+		return fmt.Errorf("could not move messages: %v", err)
+	}
+
+	attachmentIDs, err := messages.Distinct(ctx, "messageBody.attachmentId", bson.M{
+		"threadId":    thread.ThreadID,
+		"messageType": model.File,
+	})
+	if err != nil {
+		return fmt.Errorf("could not find attachments: %v", err)
+	}
+	if len(attachmentIDs) > 0 {
+		_, err = db.Collection(cfg.AttachmentColl).UpdateMany(ctx,
+			bson.M{"attachmentId": bson.M{"$in": attachmentIDs}, "threadId": legacyID},
+			bson.M{"$set": bson.M{"threadId": thread.ThreadID}},
+		)
+		if err != nil {
+			return fmt.Errorf("could not move attachments: %v", err)
+		}
+	}
+
+	// A keyed thread of the users may exist already, its messages and the moved ones are numbered
+	// together in the order they were created
+	seq, err := renumberMessages(ctx, messages, thread.ThreadID)
+	if err != nil {
+		return fmt.Errorf("could not renumber messages: %v", err)
+	}
+	if seq > thread.LastSeq {
+		thread.LastSeq = seq
+	}
+
+	update := bson.M{
+		"$setOnInsert": bson.M{"userId1": thread.UserID1, "userId2": thread.UserID2},
+		"$max":         bson.M{"lastSeq": thread.LastSeq, "updatedAt": thread.UpdatedAt},
+		"$addToSet":    bson.M{"mutedBy": bson.M{"$each": append([]string{}, thread.MutedBy...)}},
+	}
+	filter := bson.M{"threadId": thread.ThreadID}
+	_, err = db.Collection(cfg.ThreadColl).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent run inserted the thread first
+		_, err = db.Collection(cfg.ThreadColl).UpdateOne(ctx, filter, update)
+	}
+	if err != nil {
+		return fmt.Errorf("could not store thread: %v", err)
+	}
+	return nil
+}
+
+// pair is a pair of user ids in sorted order
+type pair [2]string
+
+func newPair(u1, u2 string) pair {
+	if u2 < u1 {
+		return pair{u2, u1}
+	}
+	return pair{u1, u2}
+}
+
+// messagePairs returns the user pairs which exchanged messages in the thread
+func messagePairs(ctx context.Context, messages *mongo.Collection, threadID string) (map[pair]bool, error) {
+	cur, err := messages.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"threadId": threadID}}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"senderId": "$senderId", "receiverId": "$receiverId"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ID struct {
+			SenderID   string `bson:"senderId"`
+			ReceiverID string `bson:"receiverId"`
+		} `bson:"_id"`
+	}
+	err = cur.All(ctx, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make(map[pair]bool, len(groups))
+	for _, g := range groups {
+		pairs[newPair(g.ID.SenderID, g.ID.ReceiverID)] = true
+	}
+	return pairs, nil
+}
@@ -0,0 +1,72 @@
+package migration
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var epoch = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// message returns a message with the seq, created the minutes after the epoch
+func message(seq int64, minutes int) *seqMessage {
+	return &seqMessage{ID: primitive.NewObjectID(), Seq: seq, CreatedAt: epoch.Add(time.Duration(minutes) * time.Minute)}
+}
+
+// checkSeqs fails the test unless the messages have the seqs
+func checkSeqs(t *testing.T, msgs []*seqMessage, want []int64) {
+	t.Helper()
+	for i, m := range msgs {
+		if m.Seq != want[i] {
+			t.Errorf("message %d has seq %d, want %d", i, m.Seq, want[i])
+		}
+	}
+}
+
+func TestRenumberMergedThreads(t *testing.T) {
+	// The second document of the thread was created after the first stopped being used, both
+	// numbered their messages from 1
+	first := []*seqMessage{message(1, 0), message(2, 1), message(3, 2)}
+	second := []*seqMessage{message(1, 3), message(2, 4), message(3, 5)}
+	// A message of each created at once is ordered by id
+	tied := []*seqMessage{message(4, 6), message(4, 6)}
+	if tied[1].ID.Hex() < tied[0].ID.Hex() {
+		tied[0], tied[1] = tied[1], tied[0]
+	}
+	msgs := []*seqMessage{second[2], first[0], tied[1], second[0], first[2], tied[0], first[1], second[1]}
+
+	changed, lastSeq := renumber(msgs)
+	if lastSeq != 8 {
+		t.Errorf("last seq is %d, want 8", lastSeq)
+	}
+	if len(changed) != 5 {
+		t.Errorf("%d messages changed, want 5", len(changed))
+	}
+	checkSeqs(t, append(append(first, second...), tied...), []int64{1, 2, 3, 4, 5, 6, 7, 8})
+}
+
+func TestRenumberMovedMessages(t *testing.T) {
+	// The keyed thread was created after the legacy one, by a client of the new id scheme, and the
+	// users wrote in the legacy thread meanwhile
+	keyed := []*seqMessage{message(1, 10), message(2, 12)}
+	legacy := []*seqMessage{message(1, 0), message(2, 5), message(3, 11), message(4, 13)}
+	msgs := append(append([]*seqMessage{}, keyed...), legacy...)
+
+	_, lastSeq := renumber(msgs)
+	if lastSeq != 6 {
+		t.Errorf("last seq is %d, want 6", lastSeq)
+	}
+	checkSeqs(t, append(keyed, legacy...), []int64{3, 5, 1, 2, 4, 6})
+}
+
+func TestRenumberWithoutDuplicates(t *testing.T) {
+	// Seqs which are unique keep their order even if the creation times disagree
+	msgs := []*seqMessage{message(1, 2), message(2, 1), message(5, 0)}
+
+	changed, lastSeq := renumber(msgs)
+	if len(changed) != 0 || lastSeq != 5 {
+		t.Errorf("%d messages changed and last seq is %d, want none and 5", len(changed), lastSeq)
+	}
+	checkSeqs(t, msgs, []int64{1, 2, 5})
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxAnnouncementUsers is the maximum number of users an announcement can be sent to
+const MaxAnnouncementUsers = 1000
+
+// Announcement is a system announcement which operators send to connected users, it is sent to
+// all users without user ids
+type Announcement struct {
+	Text      string    `json:"text"`
+	UserIDs   []string  `json:"userIds,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Validate validates the announcement passed from the operator
+func (a *Announcement) Validate() error {
+	if len(a.UserIDs) > MaxAnnouncementUsers {
+		return fmt.Errorf("userIds must not contain more than %d users", MaxAnnouncementUsers)
+	}
+	return validateText("text", a.Text, MaxTextLength)
+}
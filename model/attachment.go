@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// Attachment entity definition, the content of the file is kept in the blob store
+type Attachment struct {
+	AttachmentID string     `json:"attachmentId" bson:"attachmentId"`
+	OwnerID      string     `json:"ownerId" bson:"ownerId"`
+	ThreadID     string     `json:"threadId,omitempty" bson:"threadId,omitempty"`
+	FileName     string     `json:"fileName" bson:"fileName"`
+	ContentType  string     `json:"contentType" bson:"contentType"`
+	Size         int64      `json:"size" bson:"size"`
+	Width        int        `json:"width,omitempty" bson:"width,omitempty"`
+	Height       int        `json:"height,omitempty" bson:"height,omitempty"`
+	Thumbnail    *Thumbnail `json:"thumbnail,omitempty" bson:"thumbnail,omitempty"`
+	StorageKey   string     `json:"-" bson:"storageKey"`
+	URL          string     `json:"url" bson:"-"`
+	CreatedAt    time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+// Thumbnail is a scaled down preview of an image attachment
+type Thumbnail struct {
+	ContentType string `json:"contentType" bson:"contentType"`
+	Size        int64  `json:"size" bson:"size"`
+	Width       int    `json:"width" bson:"width"`
+	Height      int    `json:"height" bson:"height"`
+	StorageKey  string `json:"-" bson:"storageKey"`
+	URL         string `json:"url" bson:"-"`
+}
@@ -0,0 +1,182 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// MaxTextLength is the maximum number of characters allowed in a text body
+	MaxTextLength = 4000
+	// MaxLabelLength is the maximum number of characters allowed in short labels such as file names
+	MaxLabelLength = 255
+)
+
+var (
+	// ErrUnknownMessageType is returned when a message has a type with no registered body
+	ErrUnknownMessageType = errors.New("unknown message type")
+	// ErrInvalidMessageBody is returned when a message body does not match its message type
+	ErrInvalidMessageBody = errors.New("invalid message body")
+)
+
+// Body defines a typed message body which can validate itself
+type Body interface {
+	Validate() error
+}
+
+// bodyTypes is the registry of message types and the body each of them carries
+var bodyTypes = map[MessageType]func() Body{
+	Text:              func() Body { return new(TextBody) },
+	SwapAgreementCard: func() Body { return new(SwapAgreement) },
+	File:              func() Body { return new(FileBody) },
+	Location:          func() Body { return new(LocationBody) },
+	System:            func() Body { return new(SystemBody) },
+}
+
+// DecodeBody converts the raw message body into the registered body of the message type
+// and validates it. On success MessageBody holds the typed body.
+func (m *Message) DecodeBody() error {
+	newBody, ok := bodyTypes[m.MessageType]
+	if !ok {
+		return fmt.Errorf("%w: '%v'", ErrUnknownMessageType, m.MessageType)
+	}
+
+	body := newBody()
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:     "json",
+		ErrorUnused: true,
+		Result:      body,
+	})
+	if err != nil {
+		return err
+	}
+	err = decoder.Decode(m.MessageBody)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessageBody, err)
+	}
+
+	err = body.Validate()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessageBody, err)
+	}
+
+	m.MessageBody = body
+	return nil
+}
+
+// TextBody is the body of a text message
+type TextBody string
+
+// Validate validates the text body
+func (b *TextBody) Validate() error {
+	return validateText("text", string(*b), MaxTextLength)
+}
+
+// FileBody is the body of a file message, the file details are filled in from the uploaded attachment
+type FileBody struct {
+	AttachmentID string `json:"attachmentId" bson:"attachmentId"`
+	FileName     string `json:"fileName" bson:"fileName"`
+	ContentType  string `json:"contentType,omitempty" bson:"contentType,omitempty"`
+	Size         int64  `json:"size,omitempty" bson:"size,omitempty"`
+	URL          string `json:"url,omitempty" bson:"url,omitempty"`
+	Width        int    `json:"width,omitempty" bson:"width,omitempty"`
+	Height       int    `json:"height,omitempty" bson:"height,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty" bson:"thumbnailUrl,omitempty"`
+}
+
+// Validate validates the file body
+func (b *FileBody) Validate() error {
+	if b.AttachmentID == "" {
+		return errors.New("attachmentId is required")
+	}
+	if utf8.RuneCountInString(b.FileName) > MaxLabelLength {
+		return fmt.Errorf("fileName must not be longer than %d characters", MaxLabelLength)
+	}
+	return nil
+}
+
+// LocationBody is the body of a location message
+type LocationBody struct {
+	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude" bson:"longitude"`
+	Label     string  `json:"label,omitempty" bson:"label,omitempty"`
+}
+
+// Validate validates the location body
+func (b *LocationBody) Validate() error {
+	if b.Latitude < -90 || b.Latitude > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if b.Longitude < -180 || b.Longitude > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if utf8.RuneCountInString(b.Label) > MaxLabelLength {
+		return fmt.Errorf("label must not be longer than %d characters", MaxLabelLength)
+	}
+	return nil
+}
+
+// SystemBody is the body of a message generated by the platform
+type SystemBody struct {
+	Event string `json:"event" bson:"event"`
+	Text  string `json:"text" bson:"text"`
+}
+
+// Validate validates the system body
+func (b *SystemBody) Validate() error {
+	if b.Event == "" {
+		return errors.New("event is required")
+	}
+	return validateText("text", b.Text, MaxTextLength)
+}
+
+// validateText checks that a text field is not blank and does not exceed max characters
+func validateText(field, s string, max int) error {
+	if strings.TrimSpace(s) == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	if utf8.RuneCountInString(s) > max {
+		return fmt.Errorf("%s must not be longer than %d characters", field, max)
+	}
+	return nil
+}
+
+// Preview returns a text of at most max characters which describes the message in notifications
+// and emails. The body may be typed, or in the shape it is read from the database in.
+func (m *Message) Preview(max int) string {
+	switch m.MessageType {
+	case File:
+		return "Sent a file"
+	case Location:
+		return "Shared a location"
+	case SwapAgreementCard:
+		return "Sent a swap agreement"
+	}
+
+	// Decode a copy, the message may be shared with other event handlers
+	msg := *m
+	if _, ok := msg.MessageBody.(Body); !ok && msg.DecodeBody() != nil {
+		return "Sent a message"
+	}
+	switch body := msg.MessageBody.(type) {
+	case *TextBody:
+		return truncate(string(*body), max)
+	case *SystemBody:
+		return truncate(body.Text, max)
+	default:
+		return "Sent a message"
+	}
+}
+
+// truncate shortens s to max characters, ending it with an ellipsis if it was cut
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:max-1]) + "…"
+}
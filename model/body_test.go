@@ -0,0 +1,43 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPreview(t *testing.T) {
+	text := TextBody("see you at noon")
+	for _, tc := range []struct {
+		messageType MessageType
+		typed       interface{}
+		stored      interface{}
+		want        string
+	}{
+		{Text, &text, "see you at noon", "see you at noon"},
+		{System, &SystemBody{Event: "swap", Text: "Swap completed"}, bson.M{"event": "swap", "text": "Swap completed"}, "Swap completed"},
+		{File, &FileBody{AttachmentID: "a"}, bson.M{"attachmentId": "a"}, "Sent a file"},
+		{Location, &LocationBody{Latitude: 1}, bson.M{"latitude": 1.0, "longitude": 0.0}, "Shared a location"},
+		{SwapAgreementCard, &SwapAgreement{}, bson.M{}, "Sent a swap agreement"},
+	} {
+		// Push notifications and emails preview both shapes alike
+		for _, body := range []interface{}{tc.typed, tc.stored} {
+			msg := &Message{MessageType: tc.messageType, MessageBody: body}
+			if got := msg.Preview(100); got != tc.want {
+				t.Errorf("preview of %s body %#v is '%s', want '%s'", tc.messageType, body, got, tc.want)
+			}
+			if !reflect.DeepEqual(msg.MessageBody, body) {
+				t.Errorf("preview of %s body changed the message", tc.messageType)
+			}
+		}
+	}
+}
+
+func TestPreviewTruncates(t *testing.T) {
+	msg := &Message{MessageType: Text, MessageBody: strings.Repeat("é", 20)}
+	if got := msg.Preview(10); got != strings.Repeat("é", 9)+"…" {
+		t.Errorf("preview is '%s', want 9 characters and an ellipsis", got)
+	}
+}
@@ -19,26 +19,50 @@ const (
 	ThreadData
 	// ErrorData message type defines any error message
 	ErrorData
+	// SwapResponseData message type defines a response to a swap agreement card
+	SwapResponseData
+	// MessageAckData message type defines the acknowledgement of a stored message
+	MessageAckData
+	// RegisterDeviceData message type defines a device registered for push notifications
+	RegisterDeviceData
+	// MuteThreadData message type defines muting or unmuting the notifications of a thread
+	MuteThreadData
+	// UserSettingsData message type defines the settings of a user
+	UserSettingsData
+	// AnnouncementData message type defines a system announcement sent by an operator
+	AnnouncementData
 )
 
 func (d DataType) String() string {
-	return [...]string{"InboxData", "MessageData", "InitData", "ErrorData"}[d]
+	return toString[d]
 }
 
 var toString = map[DataType]string{
-	InboxData:   "InboxData",
-	MessageData: "MessageData",
-	InitData:    "InitData",
-	ThreadData:  "ThreadData",
-	ErrorData:   "ErrorData",
+	InboxData:          "InboxData",
+	MessageData:        "MessageData",
+	InitData:           "InitData",
+	ThreadData:         "ThreadData",
+	ErrorData:          "ErrorData",
+	SwapResponseData:   "SwapResponseData",
+	MessageAckData:     "MessageAckData",
+	RegisterDeviceData: "RegisterDeviceData",
+	MuteThreadData:     "MuteThreadData",
+	UserSettingsData:   "UserSettingsData",
+	AnnouncementData:   "AnnouncementData",
 }
 
 var toID = map[string]DataType{
-	"InboxData":   InboxData,
-	"MessageData": MessageData,
-	"InitData":    InitData,
-	"ThreadData":  ThreadData,
-	"ErrorData":   ErrorData,
+	"InboxData":          InboxData,
+	"MessageData":        MessageData,
+	"InitData":           InitData,
+	"ThreadData":         ThreadData,
+	"ErrorData":          ErrorData,
+	"SwapResponseData":   SwapResponseData,
+	"MessageAckData":     MessageAckData,
+	"RegisterDeviceData": RegisterDeviceData,
+	"MuteThreadData":     MuteThreadData,
+	"UserSettingsData":   UserSettingsData,
+	"AnnouncementData":   AnnouncementData,
 }
 
 // MarshalJSON marshals the enum as a quoted json string
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// Platform defines the push notification platform of a device
+type Platform string
+
+const (
+	// Android devices receive notifications through FCM
+	Android Platform = "Android"
+	// IOS devices receive notifications through APNs
+	IOS Platform = "IOS"
+)
+
+// Device entity definition, a device registered by a user to receive push notifications
+type Device struct {
+	UserID    string    `json:"-" bson:"userId"`
+	Platform  Platform  `json:"platform" bson:"platform"`
+	Token     string    `json:"token" bson:"token"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// Validate validates the device passed from the client
+func (d *Device) Validate() error {
+	if d.Platform != Android && d.Platform != IOS {
+		return errors.New("platform must be 'Android' or 'IOS'")
+	}
+	if d.Token == "" || len(d.Token) > 4096 {
+		return errors.New("token must not be empty or longer than 4096 characters")
+	}
+	return nil
+}
+
+// ThreadMute is passed from the client to mute or unmute notifications of a thread
+type ThreadMute struct {
+	ThreadID string `json:"threadId"`
+	Muted    bool   `json:"muted"`
+}
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// Event entity definition, an event is anything delivered to a user which is recorded in the
+// user's sync log so that a reconnecting client can catch up on what it missed
+type Event struct {
+	UserID    string      `json:"-" bson:"userId"`
+	SourceID  string      `json:"-" bson:"sourceId,omitempty"`
+	Seq       int64       `json:"seq" bson:"seq"`
+	DataType  DataType    `json:"dataType" bson:"dataType"`
+	Data      interface{} `json:"data" bson:"data"`
+	CreatedAt time.Time   `json:"createdAt" bson:"createdAt"`
+}
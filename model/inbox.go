@@ -3,4 +3,8 @@ package model
 // Inbox entity definitation
 type Inbox struct {
 	Threads []*Thread `json:"threads,omitempty" bson:"threads"`
+	LastSeq int64     `json:"lastSeq" bson:"-"`
+
+	// Incomplete is set when some threads of the user could not be loaded
+	Incomplete bool `json:"incomplete,omitempty" bson:"-"`
 }
@@ -4,56 +4,39 @@ import (
 	"time"
 )
 
-// // MessageType defines the type of the message
-// type MessageType int
-
-// const (
-// 	// Text message type
-// 	Text MessageType = iota
-// 	// SwapAgreementCard message type
-// 	SwapAgreementCard
-// )
-
-// func (d MessageType) String() string {
-// 	return [...]string{"Text", "SwapAgreementCard"}[d]
-// }
-
-// var msgToString = map[MessageType]string{
-// 	Text:              "Text",
-// 	SwapAgreementCard: "SwapAgreementCard",
-// }
-
-// var msgToID = map[string]MessageType{
-// 	"Text":              Text,
-// 	"SwapAgreementCard": SwapAgreementCard,
-// }
-
-// // MarshalJSON marshals the enum as a quoted json string
-// func (d MessageType) MarshalJSON() ([]byte, error) {
-// 	buffer := bytes.NewBufferString(`"`)
-// 	buffer.WriteString(msgToString[d])
-// 	buffer.WriteString(`"`)
-// 	return buffer.Bytes(), nil
-// }
-
-// // UnmarshalJSON unmashals a quoted json string to the enum value
-// func (d *MessageType) UnmarshalJSON(b []byte) error {
-// 	var j string
-// 	err := json.Unmarshal(b, &j)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	// Note that if the string cannot be found then it will be set to the zero value, 'Created' in this case.
-// 	*d = msgToID[j]
-// 	return nil
-// }
+// MessageType defines the type of the message body
+type MessageType string
+
+const (
+	// Text message type carries a plain text body
+	Text MessageType = "Text"
+	// SwapAgreementCard message type carries a swap agreement card
+	SwapAgreementCard MessageType = "SwapAgreementCard"
+	// File message type carries a reference to an uploaded file
+	File MessageType = "File"
+	// Location message type carries a geographic location
+	Location MessageType = "Location"
+	// System message type carries a message generated by the platform
+	System MessageType = "System"
+)
 
-// Message entity definition
+// Message entity definition, Seq is assigned when the message is stored and strictly increases
+// within a thread. ClientMessageID is generated by the client and makes resending a message safe.
 type Message struct {
-	ThreadID    string      `json:"threadId" bson:"threadId"`
-	SenderID    string      `json:"senderId" bson:"senderId"`
-	ReceiverID  string      `json:"receiverId" bson:"receiverId"`
-	MessageType string      `json:"messageType" bson:"messageType"`
-	MessageBody interface{} `json:"messageBody" bson:"messageBody"`
-	CreatedAt   time.Time   `json:"createdAt" bson:"createdAt"`
+	ThreadID        string      `json:"threadId" bson:"threadId"`
+	Seq             int64       `json:"seq" bson:"seq"`
+	ClientMessageID string      `json:"clientMessageId,omitempty" bson:"clientMessageId,omitempty"`
+	SenderID        string      `json:"senderId" bson:"senderId"`
+	ReceiverID      string      `json:"receiverId" bson:"receiverId"`
+	MessageType     MessageType `json:"messageType" bson:"messageType"`
+	MessageBody     interface{} `json:"messageBody" bson:"messageBody"`
+	CreatedAt       time.Time   `json:"createdAt" bson:"createdAt"`
+}
+
+// MessageAck is sent to the sender once a message is stored, Duplicate is set when the message
+// was already stored by an earlier submission with the same client message id
+type MessageAck struct {
+	ClientMessageID string   `json:"clientMessageId,omitempty"`
+	Duplicate       bool     `json:"duplicate"`
+	Message         *Message `json:"message"`
 }
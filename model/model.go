@@ -1,20 +1,31 @@
 package model
 
-// Data entity definition
+// Data entity definition, Seq is the seq of the data in the sync log of the user. Live data may
+// arrive out of seq order, so a client keeps the highest seq up to which it has seen every seq
+// to pass as Auth.LastSeq.
 type Data struct {
 	DataType DataType    `json:"dataType"`
 	Data     interface{} `json:"data"`
+	Seq      int64       `json:"seq,omitempty"`
 	UserID   string      `json:"-"`
+
+	// TraceParent optionally continues the trace of the client in w3c traceparent format
+	TraceParent string `json:"traceparent,omitempty"`
 }
 
-// Auth data is passed from the client when authenticating the client
+// Auth data is passed from the client when authenticating the client, a reconnecting client
+// passes the seq of the last event it has seen to receive only the events it missed
 type Auth struct {
-	Token  string `json:"token"`
-	UserID string `json:"userId"`
+	Token   string `json:"token"`
+	UserID  string `json:"userId"`
+	LastSeq int64  `json:"lastSeq"`
 }
 
 // Error data is defines any errors sent from server to client
 type Error struct {
 	Details string `json:"details"`
 	Code    string `json:"code"`
+
+	// RetryAfter is the number of seconds after which a rate limited request may be retried
+	RetryAfter float64 `json:"retryAfter,omitempty"`
 }
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// OutboxEntry entity definition, a domain event which is written in the same transaction as the
+// change it describes and published to the event bus by the outbox relay
+type OutboxEntry struct {
+	EntryID     string     `json:"entryId" bson:"_id"`
+	Event       string     `json:"event" bson:"event"`
+	Message     *Message   `json:"message,omitempty" bson:"message,omitempty"`
+	Thread      *Thread    `json:"thread,omitempty" bson:"thread,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt" bson:"createdAt"`
+	LockedUntil time.Time  `json:"lockedUntil" bson:"lockedUntil"`
+	PublishedAt *time.Time `json:"publishedAt" bson:"publishedAt"`
+
+	// TraceParent is the span which wrote the entry, publishing it continues its trace
+	TraceParent string `json:"traceParent,omitempty" bson:"traceParent,omitempty"`
+}
+
+// Data returns the payload of the event
+func (e *OutboxEntry) Data() interface{} {
+	if e.Message != nil {
+		return e.Message
+	}
+	return e.Thread
+}
@@ -1,6 +1,79 @@
 package model
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SwapStatus defines the state of a swap agreement card
+type SwapStatus string
+
+const (
+	// SwapProposed is the initial state of a swap agreement card
+	SwapProposed SwapStatus = "Proposed"
+	// SwapAccepted is set when the counterparty accepts the swap agreement
+	SwapAccepted SwapStatus = "Accepted"
+	// SwapDeclined is set when the counterparty declines the swap agreement
+	SwapDeclined SwapStatus = "Declined"
+	// SwapCancelled is set when the proposer withdraws the swap agreement
+	SwapCancelled SwapStatus = "Cancelled"
+)
+
+// ErrInvalidSwapTransition is returned when a swap agreement cannot move to the requested status
+var ErrInvalidSwapTransition = errors.New("invalid swap agreement transition")
+
 // SwapAgreement is the object definition which stores swap information in message thread
 type SwapAgreement struct {
-	SwapAgreementID string `json:"swapAgreementId" bson:"swapAgreementId"`
+	SwapAgreementID string     `json:"swapAgreementId" bson:"swapAgreementId"`
+	Status          SwapStatus `json:"status" bson:"status"`
+	RespondedBy     string     `json:"respondedBy,omitempty" bson:"respondedBy,omitempty"`
+	UpdatedAt       time.Time  `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+// Validate validates a newly proposed swap agreement card, the status defaults to proposed
+func (s *SwapAgreement) Validate() error {
+	if s.SwapAgreementID == "" {
+		return errors.New("swapAgreementId is required")
+	}
+	if s.Status == "" {
+		s.Status = SwapProposed
+	}
+	if s.Status != SwapProposed {
+		return fmt.Errorf("a new swap agreement must have status '%v'", SwapProposed)
+	}
+	if s.RespondedBy != "" {
+		return errors.New("respondedBy must not be set on a new swap agreement")
+	}
+	return nil
+}
+
+// CanTransition checks if the swap agreement can move to the next status. Only the counterparty
+// can accept or decline a proposal and only the proposer can cancel it.
+func (s *SwapAgreement) CanTransition(next SwapStatus, byProposer bool) error {
+	if s.Status != SwapProposed {
+		return fmt.Errorf("%w: swap agreement is already '%v'", ErrInvalidSwapTransition, s.Status)
+	}
+
+	switch next {
+	case SwapAccepted, SwapDeclined:
+		if byProposer {
+			return fmt.Errorf("%w: the proposer cannot set status '%v'", ErrInvalidSwapTransition, next)
+		}
+	case SwapCancelled:
+		if !byProposer {
+			return fmt.Errorf("%w: only the proposer can cancel", ErrInvalidSwapTransition)
+		}
+	default:
+		return fmt.Errorf("%w: unknown status '%v'", ErrInvalidSwapTransition, next)
+	}
+
+	return nil
+}
+
+// SwapResponse is passed from the client when responding to a swap agreement card
+type SwapResponse struct {
+	ThreadID        string     `json:"threadId"`
+	SwapAgreementID string     `json:"swapAgreementId"`
+	Status          SwapStatus `json:"status"`
 }
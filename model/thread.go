@@ -1,10 +1,12 @@
 package model
 
 import (
-	"strconv"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
 	"time"
-
-	"github.com/mitchellh/hashstructure"
 )
 
 // Thread entity definition
@@ -13,33 +15,38 @@ type Thread struct {
 	UserID1   string     `json:"userId1" bson:"userId1"`
 	UserID2   string     `json:"userId2" bson:"userId2"`
 	Messages  []*Message `json:"messages,omitempty" bson:"messages"`
+	LastSeq   int64      `json:"lastSeq" bson:"lastSeq"`
+	MutedBy   []string   `json:"mutedBy,omitempty" bson:"mutedBy,omitempty"`
 	UpdatedAt time.Time  `json:"updatedAt" bson:"updatedAt"`
-}
-
-// GenerateThreadIDHash generates a thread id using two user ids
-func GenerateThreadIDHash(u1, u2 string) (string, error) {
-	type ComplexStruct struct {
-		Data []string `hash:"set"`
-	}
 
-	v := ComplexStruct{
-		Data: []string{
-			u1, u2,
-		},
-	}
+	// MessagesIncomplete is set when some messages of the thread could not be loaded
+	MessagesIncomplete bool `json:"messagesIncomplete,omitempty" bson:"-"`
+}
 
-	hash, err := hashstructure.Hash(v, nil)
-	if err != nil {
-		panic(err)
+// GenerateThreadID generates the thread id of two users as the HMAC-SHA256 of the sorted user ids
+// under the key, so the id does not depend on who sent the first message and cannot be derived
+// from the user ids without the key
+func GenerateThreadID(key []byte, u1, u2 string) string {
+	users := []string{u1, u2}
+	sort.Strings(users)
+
+	// Prefix each id with its length so that no two pairs of ids produce the same input
+	mac := hmac.New(sha256.New, key)
+	for _, u := range users {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(u)))
+		mac.Write(n[:])
+		mac.Write([]byte(u))
 	}
-
-	h := strconv.FormatUint(hash, 10)
-	return h, nil
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-// GetMessagesInThreadRequest defines entity for getting all messages in a thread
+// GetMessagesInThreadRequest defines entity for getting all messages in a thread. Messages are
+// returned newest first, BeforeSeq pages back in history and AfterSeq fills a gap after a seq.
 type GetMessagesInThreadRequest struct {
-	ThreadID string `json:"threadId"`
-	Limit    int    `json:"limit"`
-	Skip     int    `json:"skip"`
+	ThreadID  string `json:"threadId"`
+	Limit     int    `json:"limit"`
+	Skip      int    `json:"skip"`
+	BeforeSeq int64  `json:"beforeSeq"`
+	AfterSeq  int64  `json:"afterSeq"`
 }
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"errors"
+	"net/mail"
+	"time"
+)
+
+// UserSettings entity definition, the email and digest opt-out are set by the user, the
+// timestamps are maintained by the server
+type UserSettings struct {
+	UserID       string    `json:"-" bson:"userId"`
+	Email        string    `json:"email" bson:"email,omitempty"`
+	DigestOptOut bool      `json:"digestOptOut" bson:"digestOptOut"`
+	LastSeenAt   time.Time `json:"-" bson:"lastSeenAt,omitempty"`
+	LastDigestAt time.Time `json:"-" bson:"lastDigestAt,omitempty"`
+}
+
+// Validate validates the settings passed from the client
+func (u *UserSettings) Validate() error {
+	if u.Email == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(u.Email)
+	if err != nil || addr.Address != u.Email {
+		return errors.New("email is not a valid address")
+	}
+	return nil
+}
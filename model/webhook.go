@@ -0,0 +1,36 @@
+package model
+
+import "time"
+
+const (
+	// EventMessageStored is published when a new message is stored
+	EventMessageStored = "message.stored"
+	// EventThreadCreated is published when a new thread is created
+	EventThreadCreated = "thread.created"
+	// EventSwapAgreementUpdated is published when a swap agreement card changes its status
+	EventSwapAgreementUpdated = "swap_agreement.updated"
+)
+
+// WebhookDelivery entity definition, a log entry of a single webhook delivery attempt
+type WebhookDelivery struct {
+	DeliveryID     string    `json:"deliveryId" bson:"deliveryId"`
+	SubscriptionID string    `json:"subscriptionId" bson:"subscriptionId"`
+	Event          string    `json:"event" bson:"event"`
+	Attempt        int       `json:"attempt" bson:"attempt"`
+	StatusCode     int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error          string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMS     int64     `json:"durationMs" bson:"durationMs"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// WebhookDeadLetter entity definition, a webhook delivery which failed all its attempts
+type WebhookDeadLetter struct {
+	DeliveryID     string    `json:"deliveryId" bson:"deliveryId"`
+	SubscriptionID string    `json:"subscriptionId" bson:"subscriptionId"`
+	URL            string    `json:"url" bson:"url"`
+	Event          string    `json:"event" bson:"event"`
+	Payload        string    `json:"payload" bson:"payload"`
+	Attempts       int       `json:"attempts" bson:"attempts"`
+	LastError      string    `json:"lastError" bson:"lastError"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+}
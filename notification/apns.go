@@ -0,0 +1,153 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+)
+
+// apnsTokenTTL is how long a provider token is reused, apple rejects tokens older than an hour
+const apnsTokenTTL = 50 * time.Minute
+
+type apnsProvider struct {
+	client   *http.Client
+	endpoint string
+	topic    string
+	keyID    string
+	teamID   string
+	key      *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func (ap *apnsProvider) Send(ctx context.Context, token string, n *Notification) error {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{
+				"title": n.Title,
+				"body":  n.Body,
+			},
+			"sound":     "default",
+			"thread-id": n.ThreadID,
+		},
+		"threadId": n.ThreadID,
+		"senderId": n.SenderID,
+		"count":    n.Count,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	jwt, err := ap.providerToken()
+	if err != nil {
+		return fmt.Errorf("could not sign apns token: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ap.endpoint+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+jwt)
+	req.Header.Set("apns-topic", ap.topic)
+	req.Header.Set("apns-push-type", "alert")
+	if len(n.ThreadID) <= 64 {
+		req.Header.Set("apns-collapse-id", n.ThreadID)
+	}
+
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode == http.StatusGone || result.Reason == "BadDeviceToken" || result.Reason == "Unregistered" {
+		return ErrInvalidToken
+	}
+	return fmt.Errorf("apns returned status %d '%s'", resp.StatusCode, result.Reason)
+}
+
+// providerToken returns the signed ES256 jwt used to authenticate with apns
+func (ap *apnsProvider) providerToken() (string, error) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	if ap.token != "" && time.Since(ap.issuedAt) < apnsTokenTTL {
+		return ap.token, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": ap.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": ap.teamID, "iat": now.Unix()})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, ap.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// The signature is r and s left padded to 32 bytes each
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	ap.token = unsigned + "." + enc.EncodeToString(sig)
+	ap.issuedAt = now
+	return ap.token, nil
+}
+
+// NewAPNsProvider returns a provider which sends notifications to ios devices through APNs using
+// the .p8 signing key from the config
+func NewAPNsProvider(cfg config.APNsConfig) (Provider, error) {
+	raw, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read apns key: %v", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("apns key is not pem encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse apns key: %v", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns key is not an ecdsa key")
+	}
+
+	return &apnsProvider{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: cfg.Endpoint,
+		topic:    cfg.Topic,
+		keyID:    cfg.KeyID,
+		teamID:   cfg.TeamID,
+		key:      key,
+	}, nil
+}
@@ -0,0 +1,241 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/repository"
+)
+
+// Store defines the data the dispatcher reads
+type Store interface {
+	FindThreadByID(ctx context.Context, threadID string) (*model.Thread, error)
+	GetDevicesByUserID(ctx context.Context, userID string) ([]*model.Device, error)
+	DeleteDevice(ctx context.Context, token string) error
+}
+
+// Presence reports whether a user is connected
+type Presence interface {
+	IsOnline(userID string) bool
+}
+
+// Dispatcher sends push notifications to recipients who are not connected. Messages to the same
+// recipient in the same thread within the collapse window are sent as a single notification.
+type Dispatcher struct {
+	store     Store
+	presence  Presence
+	providers map[model.Platform]Provider
+	window    time.Duration
+	timeout   time.Duration
+	jobs      chan *Notification
+	workers   sync.WaitGroup
+
+	mu        sync.Mutex
+	pending   map[string]*Notification
+	seen      map[string]time.Time
+	lastSweep time.Time
+	closed    bool
+}
+
+// seenRetention is how long the dispatcher remembers the events it handled
+const seenRetention = 10 * time.Minute
+
+// Notify queues a notification about the message for its receiver if they are offline
+func (d *Dispatcher) Notify(msg *model.Message) {
+	if msg.ReceiverID == msg.SenderID || d.presence.IsOnline(msg.ReceiverID) {
+		return
+	}
+
+	key := msg.ReceiverID + "/" + msg.ThreadID
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	if n, ok := d.pending[key]; ok {
+		n.Count++
+		n.Body = preview(msg)
+		return
+	}
+
+	d.pending[key] = &Notification{
+		UserID:   msg.ReceiverID,
+		ThreadID: msg.ThreadID,
+		SenderID: msg.SenderID,
+		Body:     preview(msg),
+		Count:    1,
+	}
+	time.AfterFunc(d.window, func() { d.flush(key) })
+}
+
+// HandleEvent notifies the receiver of stored messages, it subscribes the dispatcher to the event
+// bus. An event published again within the seen retention does not notify again.
+func (d *Dispatcher) HandleEvent(e eventbus.Event) error {
+	msg, ok := e.Data.(*model.Message)
+	if !ok || e.Name != model.EventMessageStored || d.seenBefore(e.ID) {
+		return nil
+	}
+	d.Notify(msg)
+	return nil
+}
+
+// seenBefore records the event id and reports whether it was recorded before
+func (d *Dispatcher) seenBefore(eventID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) > time.Minute {
+		d.lastSweep = now
+		for id, at := range d.seen {
+			if now.Sub(at) > seenRetention {
+				delete(d.seen, id)
+			}
+		}
+	}
+	if _, ok := d.seen[eventID]; ok {
+		return true
+	}
+	d.seen[eventID] = now
+	return false
+}
+
+// flush moves the collapsed notification to the job queue, unless it was flushed on shutdown
+func (d *Dispatcher) flush(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.closed {
+		d.queue(key)
+	}
+}
+
+// queue moves the pending notification to the job queue, the caller holds the lock
+func (d *Dispatcher) queue(key string) {
+	n := d.pending[key]
+	delete(d.pending, key)
+
+	n.Title = "New message"
+	if n.Count > 1 {
+		n.Title = fmt.Sprintf("%d new messages", n.Count)
+	}
+
+	select {
+	case d.jobs <- n:
+	default:
+		logger.Default().Warn("push queue is full, dropping notification", "userId", n.UserID)
+	}
+}
+
+// Shutdown sends the notifications which are still collapsing without waiting for the end of
+// their window, and waits until the queued notifications are sent or the context is done.
+// Messages notified after the shutdown are dropped.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for key := range d.pending {
+			d.queue(key)
+		}
+		close(d.jobs)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("push notifications were not sent: %v", ctx.Err())
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for n := range d.jobs {
+		err := d.send(n)
+		if err != nil {
+			logger.Default().Error("could not send push notification", "userId", n.UserID, "error", err)
+		}
+	}
+}
+
+func (d *Dispatcher) send(n *Notification) error {
+	// The user may have connected in the meantime
+	if d.presence.IsOnline(n.UserID) {
+		return nil
+	}
+
+	// The notification is sent within the timeout on all devices
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	thread, err := d.store.FindThreadByID(ctx, n.ThreadID)
+	if err != nil {
+		return fmt.Errorf("could not find thread: %v", err)
+	}
+	for _, userID := range thread.MutedBy {
+		if userID == n.UserID {
+			return nil
+		}
+	}
+
+	// Devices which could not be loaded are skipped
+	devices, err := d.store.GetDevicesByUserID(ctx, n.UserID)
+	if err != nil {
+		var partial *repository.PartialError
+		if !errors.As(err, &partial) {
+			return fmt.Errorf("could not fetch devices: %v", err)
+		}
+		logger.Default().Warn("could not load some devices", "userId", n.UserID, "error", err)
+	}
+
+	for _, device := range devices {
+		provider, ok := d.providers[device.Platform]
+		if !ok {
+			continue
+		}
+
+		err := provider.Send(ctx, device.Token, n)
+		if errors.Is(err, ErrInvalidToken) {
+			err = d.store.DeleteDevice(ctx, device.Token)
+		}
+		if err != nil {
+			logger.Default().Error("could not notify device", "platform", device.Platform, "userId", n.UserID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// NewDispatcher returns a dispatcher which sends notifications with the provider of each platform
+// from the configured number of workers
+func NewDispatcher(store Store, presence Presence, providers map[model.Platform]Provider, cfg config.Config) *Dispatcher {
+	d := &Dispatcher{
+		store:     store,
+		presence:  presence,
+		providers: providers,
+		window:    cfg.PushCollapseWindow,
+		timeout:   cfg.RequestTimeout,
+		jobs:      make(chan *Notification, 1024),
+		pending:   make(map[string]*Notification),
+		seen:      make(map[string]time.Time),
+	}
+	d.workers.Add(cfg.PushWorkers)
+	for i := 0; i < cfg.PushWorkers; i++ {
+		go d.work()
+	}
+	return d
+}
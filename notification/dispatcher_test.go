@@ -0,0 +1,202 @@
+package notification
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/repository"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	thread  *model.Thread
+	devices []*model.Device
+	deleted []string
+}
+
+func (fs *fakeStore) FindThreadByID(ctx context.Context, threadID string) (*model.Thread, error) {
+	return fs.thread, nil
+}
+
+func (fs *fakeStore) GetDevicesByUserID(ctx context.Context, userID string) ([]*model.Device, error) {
+	return fs.devices, nil
+}
+
+func (fs *fakeStore) DeleteDevice(ctx context.Context, token string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.deleted = append(fs.deleted, token)
+	return nil
+}
+
+type fakePresence map[string]bool
+
+func (fp fakePresence) IsOnline(userID string) bool {
+	return fp[userID]
+}
+
+// newTestDispatcher returns a dispatcher without workers, its jobs are read by the test
+func newTestDispatcher(store Store, provider Provider, window time.Duration) *Dispatcher {
+	cfg := config.Config{PushCollapseWindow: window, RequestTimeout: time.Second}
+	return NewDispatcher(store, fakePresence{}, map[model.Platform]Provider{model.Android: provider}, cfg)
+}
+
+func textMessage(text string) *model.Message {
+	body := model.TextBody(text)
+	return &model.Message{ThreadID: "t", SenderID: "a", ReceiverID: "b", MessageType: model.Text, MessageBody: &body}
+}
+
+func TestCollapseWindow(t *testing.T) {
+	d := newTestDispatcher(&fakeStore{}, &FakeProvider{}, 20*time.Millisecond)
+
+	d.Notify(textMessage("one"))
+	d.Notify(textMessage("two"))
+	d.Notify(textMessage("three"))
+
+	select {
+	case n := <-d.jobs:
+		if n.Count != 3 || n.Title != "3 new messages" || n.Body != "three" {
+			t.Errorf("notification is %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification after the collapse window")
+	}
+
+	d.Notify(textMessage("four"))
+	select {
+	case n := <-d.jobs:
+		if n.Count != 1 || n.Title != "New message" {
+			t.Errorf("notification after the window is %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification after the second collapse window")
+	}
+}
+
+// storedEntry returns the outbox entry of the message as the relay reads it from the database
+func storedEntry(t *testing.T, msg *model.Message) *model.OutboxEntry {
+	raw, err := bson.Marshal(&model.OutboxEntry{EntryID: "entry", Event: model.EventMessageStored, Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry model.OutboxEntry
+	err = bson.UnmarshalWithRegistry(repository.NewRegistry(), raw, &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &entry
+}
+
+func TestPreviewOfStoredMessages(t *testing.T) {
+	text := model.TextBody("see you at noon")
+	for _, tc := range []struct {
+		msg  *model.Message
+		want string
+	}{
+		{&model.Message{MessageType: model.Text, MessageBody: &text}, "see you at noon"},
+		{&model.Message{MessageType: model.System, MessageBody: &model.SystemBody{Event: "swap", Text: "Swap completed"}}, "Swap completed"},
+		{&model.Message{MessageType: model.File, MessageBody: &model.FileBody{AttachmentID: "a", FileName: "a.png"}}, "Sent a file"},
+		{&model.Message{MessageType: model.Location, MessageBody: &model.LocationBody{Latitude: 1, Longitude: 2}}, "Shared a location"},
+	} {
+		d := newTestDispatcher(&fakeStore{}, &FakeProvider{}, time.Millisecond)
+		tc.msg.ThreadID, tc.msg.SenderID, tc.msg.ReceiverID = "t", "a", "b"
+		entry := storedEntry(t, tc.msg)
+		err := d.HandleEvent(eventbus.Event{ID: entry.EntryID, Name: entry.Event, Data: entry.Data()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case n := <-d.jobs:
+			if n.Body != tc.want {
+				t.Errorf("preview of a stored %s message is '%s', want '%s'", tc.msg.MessageType, n.Body, tc.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no notification of a stored %s message", tc.msg.MessageType)
+		}
+	}
+}
+
+func TestMutedThread(t *testing.T) {
+	provider := &FakeProvider{}
+	store := &fakeStore{
+		thread:  &model.Thread{ThreadID: "t", MutedBy: []string{"b"}},
+		devices: []*model.Device{{UserID: "b", Platform: model.Android, Token: "device"}},
+	}
+	d := newTestDispatcher(store, provider, time.Hour)
+
+	err := d.send(&Notification{UserID: "b", ThreadID: "t", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := provider.Sent(); len(sent) != 0 {
+		t.Errorf("sent %d notifications to a user who muted the thread", len(sent))
+	}
+
+	err = d.send(&Notification{UserID: "a", ThreadID: "t", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := provider.Sent(); len(sent) != 1 {
+		t.Errorf("sent %d notifications to a user who did not mute the thread, want 1", len(sent))
+	}
+}
+
+func TestInvalidTokenCleanup(t *testing.T) {
+	provider := &FakeProvider{InvalidTokens: map[string]bool{"stale": true}}
+	store := &fakeStore{
+		thread: &model.Thread{ThreadID: "t"},
+		devices: []*model.Device{
+			{UserID: "b", Platform: model.Android, Token: "stale"},
+			{UserID: "b", Platform: model.Android, Token: "fresh"},
+		},
+	}
+	d := newTestDispatcher(store, provider, time.Hour)
+
+	err := d.send(&Notification{UserID: "b", ThreadID: "t", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.deleted) != 1 || store.deleted[0] != "stale" {
+		t.Errorf("deleted devices %v, want [stale]", store.deleted)
+	}
+	if sent := provider.Sent(); len(sent) != 1 || sent[0].Token != "fresh" {
+		t.Errorf("sent %v, want a notification to fresh", sent)
+	}
+}
+
+func TestShutdownSendsCollapsingNotifications(t *testing.T) {
+	provider := &FakeProvider{}
+	store := &fakeStore{
+		thread:  &model.Thread{ThreadID: "t"},
+		devices: []*model.Device{{UserID: "b", Platform: model.Android, Token: "device"}},
+	}
+	cfg := config.Config{PushCollapseWindow: time.Hour, RequestTimeout: time.Second, PushWorkers: 2}
+	d := NewDispatcher(store, fakePresence{}, map[model.Platform]Provider{model.Android: provider}, cfg)
+
+	d.Notify(textMessage("one"))
+	d.Notify(textMessage("two"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := provider.Sent()
+	if len(sent) != 1 || sent[0].Notification.Count != 2 {
+		t.Fatalf("sent %v, want one notification of both messages", sent)
+	}
+
+	// Messages after the shutdown are dropped
+	d.Notify(textMessage("three"))
+	if n := len(provider.Sent()); n != 1 {
+		t.Errorf("sent %d notifications after the shutdown, want none", n-1)
+	}
+}
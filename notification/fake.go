@@ -0,0 +1,40 @@
+package notification
+
+import (
+	"context"
+	"sync"
+)
+
+// Sent is a notification recorded by the fake provider
+type Sent struct {
+	Token        string
+	Notification Notification
+}
+
+// FakeProvider records notifications instead of sending them, it is meant for tests and
+// local development
+type FakeProvider struct {
+	mu            sync.Mutex
+	sent          []Sent
+	InvalidTokens map[string]bool
+}
+
+// Send records the notification, tokens listed in InvalidTokens are rejected
+func (fp *FakeProvider) Send(ctx context.Context, token string, n *Notification) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.InvalidTokens[token] {
+		return ErrInvalidToken
+	}
+	fp.sent = append(fp.sent, Sent{Token: token, Notification: *n})
+	return nil
+}
+
+// Sent returns the recorded notifications
+func (fp *FakeProvider) Sent() []Sent {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return append([]Sent(nil), fp.sent...)
+}
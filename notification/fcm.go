@@ -0,0 +1,250 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+)
+
+// fcmScope is the oauth2 scope of the FCM HTTP v1 api
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// fcmTokenMargin is how long before its expiry an access token is replaced
+const fcmTokenMargin = time.Minute
+
+type fcmProvider struct {
+	client      *http.Client
+	endpoint    string
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// serviceAccount is the part of a google service account key file the provider uses
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type fcmRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Notification fcmNotification   `json:"notification"`
+	Data         map[string]string `json:"data"`
+	Android      fcmAndroid        `json:"android"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type fcmAndroid struct {
+	CollapseKey string `json:"collapse_key"`
+}
+
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+func (fp *fcmProvider) Send(ctx context.Context, token string, n *Notification) error {
+	body, err := json.Marshal(fcmRequest{Message: fcmMessage{
+		Token: token,
+		Notification: fcmNotification{
+			Title: n.Title,
+			Body:  n.Body,
+		},
+		Data: map[string]string{
+			"threadId": n.ThreadID,
+			"senderId": n.SenderID,
+			"count":    strconv.Itoa(n.Count),
+		},
+		Android: fcmAndroid{CollapseKey: n.ThreadID},
+	}})
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := fp.token(ctx)
+	if err != nil {
+		return fmt.Errorf("could not authenticate with fcm: %v", err)
+	}
+
+	u := fp.endpoint + "/v1/projects/" + url.PathEscape(fp.projectID) + "/messages:send"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := fp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var result fcmError
+	json.NewDecoder(resp.Body).Decode(&result)
+	for _, d := range result.Error.Details {
+		if d.ErrorCode == "UNREGISTERED" {
+			return ErrInvalidToken
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The access token was revoked, the next send fetches another one
+		fp.mu.Lock()
+		fp.accessToken = ""
+		fp.mu.Unlock()
+	}
+	return fmt.Errorf("fcm returned status %d '%s'", resp.StatusCode, result.Error.Status)
+}
+
+// token returns an access token of the service account, which is exchanged for a signed RS256
+// jwt and reused until shortly before it expires
+func (fp *fcmProvider) token(ctx context.Context) (string, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.accessToken != "" && time.Now().Before(fp.expiresAt.Add(-fcmTokenMargin)) {
+		return fp.accessToken, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   fp.clientEmail,
+		"scope": fcmScope,
+		"aud":   fp.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, fp.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fp.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := fp.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("could not decode token response: %v", err)
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+
+	fp.accessToken = result.AccessToken
+	fp.expiresAt = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return fp.accessToken, nil
+}
+
+// NewFCMProvider returns a provider which sends notifications to android devices through the FCM
+// HTTP v1 api, authenticated with the service account key file from the config
+func NewFCMProvider(cfg config.FCMConfig) (Provider, error) {
+	raw, err := ioutil.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read fcm credentials: %v", err)
+	}
+	var account serviceAccount
+	err = json.Unmarshal(raw, &account)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode fcm credentials: %v", err)
+	}
+	if account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("fcm credentials are not a service account key")
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("fcm private key is not pem encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse fcm private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("fcm private key is not an rsa key")
+	}
+
+	projectID := cfg.ProjectID
+	if projectID == "" {
+		projectID = account.ProjectID
+	}
+	if projectID == "" {
+		return nil, errors.New("fcm project id is not set")
+	}
+
+	return &fcmProvider{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		endpoint:    strings.TrimSuffix(cfg.Endpoint, "/"),
+		projectID:   projectID,
+		clientEmail: account.ClientEmail,
+		tokenURI:    account.TokenURI,
+		key:         key,
+	}, nil
+}
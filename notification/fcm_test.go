@@ -0,0 +1,119 @@
+package notification
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shohag000/test-websocket/config"
+)
+
+// newTestFCM returns a provider whose token endpoint and api are served by a test server, and a
+// func which stops the server
+func newTestFCM(t *testing.T, send http.HandlerFunc) (Provider, *int32, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&tokens, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "expires_in": 3600})
+	})
+	mux.HandleFunc("/v1/projects/project/messages:send", send)
+	server := httptest.NewServer(mux)
+
+	dir, err := ioutil.TempDir("", "fcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+	credentials, _ := json.Marshal(serviceAccount{
+		ProjectID:   "project",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail: "push@project.iam.gserviceaccount.com",
+		TokenURI:    server.URL + "/token",
+	})
+	file := filepath.Join(dir, "credentials.json")
+	err = ioutil.WriteFile(file, credentials, 0600)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	fp, err := NewFCMProvider(config.FCMConfig{Endpoint: server.URL, CredentialsFile: file})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return fp, &tokens, cleanup
+}
+
+func TestFCMSend(t *testing.T) {
+	var got fcmRequest
+	fp, tokens, cleanup := newTestFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"name": "projects/project/messages/1"}`))
+	})
+	defer cleanup()
+
+	n := &Notification{ThreadID: "t", SenderID: "s", Title: "New message", Body: "hi", Count: 1}
+	for i := 0; i < 2; i++ {
+		err := fp.Send(context.Background(), "device", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got.Message.Token != "device" || got.Message.Android.CollapseKey != "t" || got.Message.Notification.Body != "hi" {
+		t.Errorf("sent message is %+v", got.Message)
+	}
+	if *tokens != 1 {
+		t.Errorf("fetched %d access tokens, want 1", *tokens)
+	}
+}
+
+func TestFCMUnregistered(t *testing.T) {
+	fp, _, cleanup := newTestFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": 404, "status": "NOT_FOUND", "details": [
+			{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`))
+	})
+	defer cleanup()
+
+	err := fp.Send(context.Background(), "device", &Notification{})
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("error is %v, want %v", err, ErrInvalidToken)
+	}
+}
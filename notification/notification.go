@@ -0,0 +1,35 @@
+package notification
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shohag000/test-websocket/model"
+)
+
+// maxPreviewLength is the maximum number of characters of a message shown in a notification
+const maxPreviewLength = 100
+
+// ErrInvalidToken is returned by a provider when the device token is no longer valid
+var ErrInvalidToken = errors.New("invalid device token")
+
+// Notification defines a push notification about one or more messages in a thread
+type Notification struct {
+	UserID   string
+	ThreadID string
+	SenderID string
+	Title    string
+	Body     string
+	// Count is the number of messages collapsed into the notification
+	Count int
+}
+
+// Provider defines a push notification service such as FCM or APNs
+type Provider interface {
+	Send(ctx context.Context, token string, n *Notification) error
+}
+
+// preview returns the notification text of a message
+func preview(msg *model.Message) string {
+	return msg.Preview(maxPreviewLength)
+}
@@ -0,0 +1,145 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/tracing"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// Store defines the outbox the relay reads
+type Store interface {
+	ClaimOutboxEntry(ctx context.Context, lease time.Duration) (*model.OutboxEntry, error)
+	MarkOutboxPublished(ctx context.Context, entryID string) error
+	WatchOutbox(ctx context.Context) (<-chan struct{}, error)
+}
+
+// Relay publishes outbox entries to the event bus at least once. An entry is claimed for the
+// lease duration before it is published, so concurrent relays do not publish it twice unless
+// a relay stops before marking the entry as published. An entry which a subscriber failed to
+// handle is not marked either, it is published again once its lease expires. Subscribers drop
+// such duplicates by the event id.
+type Relay struct {
+	store    Store
+	bus      *eventbus.Bus
+	interval time.Duration
+	lease    time.Duration
+	timeout  time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Run publishes new entries as soon as they are written and polls for entries whose lease
+// expired, it returns once the relay is stopped
+func (r *Relay) Run() {
+	defer close(r.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inserted, err := r.store.WatchOutbox(ctx)
+	if err != nil {
+		logger.Default().Warn("could not watch outbox, polling instead", "interval", r.interval, "error", err)
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.drain()
+
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		case _, ok := <-inserted:
+			if !ok {
+				logger.Default().Warn("outbox change stream closed, polling instead", "interval", r.interval)
+				inserted = nil
+			}
+		}
+	}
+}
+
+// Stop stops publishing entries and waits until the entry being published is handled or the
+// context is done. Entries which are not published yet are left to the other relays, or to this
+// one once it runs again.
+func (r *Relay) Stop(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("relay did not stop: %v", ctx.Err())
+	}
+}
+
+// drain publishes pending entries until there are none left or the relay is stopped
+func (r *Relay) drain() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		entry, err := r.store.ClaimOutboxEntry(ctx, r.lease)
+		cancel()
+		if err != nil {
+			if !errors.Is(err, errorcodes.ErrNotFound) {
+				logger.Default().Error("could not claim outbox entry", "error", err)
+			}
+			return
+		}
+
+		// Publishing continues the trace of the change which wrote the entry
+		ctx, span := tracing.Start(tracing.WithTraceParent(context.Background(), entry.TraceParent), "outbox.publish",
+			kv.String("event.name", entry.Event),
+			kv.String("event.id", entry.EntryID),
+		)
+		err = r.bus.Publish(eventbus.Event{
+			ID:          entry.EntryID,
+			Name:        entry.Event,
+			Data:        entry.Data(),
+			TraceParent: tracing.TraceParent(ctx),
+		})
+		if err != nil {
+			tracing.RecordError(ctx, err)
+		}
+		span.End()
+		if err != nil {
+			logger.Default().Error("could not publish outbox entry, it is retried when its lease expires", "entryId", entry.EntryID, "event", entry.Event, "error", err)
+			continue
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), r.timeout)
+		err = r.store.MarkOutboxPublished(ctx, entry.EntryID)
+		cancel()
+		if err != nil {
+			logger.Default().Error("could not mark outbox entry as published", "entryId", entry.EntryID, "error", err)
+		}
+	}
+}
+
+// NewRelay returns a relay which publishes the entries of the store to the bus
+func NewRelay(store Store, bus *eventbus.Bus, cfg config.Config) *Relay {
+	return &Relay{
+		store:    store,
+		bus:      bus,
+		interval: cfg.OutboxPollInterval,
+		lease:    cfg.OutboxLease,
+		timeout:  cfg.RequestTimeout,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
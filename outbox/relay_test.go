@@ -0,0 +1,94 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/model"
+)
+
+// fakeStore is an outbox whose entries are claimed once
+type fakeStore struct {
+	entries   []*model.OutboxEntry
+	published map[string]bool
+}
+
+func (fs *fakeStore) ClaimOutboxEntry(ctx context.Context, lease time.Duration) (*model.OutboxEntry, error) {
+	if len(fs.entries) == 0 {
+		return nil, errorcodes.ErrNotFound
+	}
+	entry := fs.entries[0]
+	fs.entries = fs.entries[1:]
+	return entry, nil
+}
+
+func (fs *fakeStore) MarkOutboxPublished(ctx context.Context, entryID string) error {
+	fs.published[entryID] = true
+	return nil
+}
+
+func (fs *fakeStore) WatchOutbox(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestDrainLeavesFailedEntriesUnpublished(t *testing.T) {
+	store := &fakeStore{
+		entries: []*model.OutboxEntry{
+			{EntryID: "ok", Event: model.EventMessageStored, Message: &model.Message{}},
+			{EntryID: "failing", Event: model.EventMessageStored, Message: &model.Message{}},
+			{EntryID: "panicking", Event: model.EventMessageStored, Message: &model.Message{}},
+		},
+		published: make(map[string]bool),
+	}
+	bus := eventbus.New()
+	handled := map[string]int{}
+	bus.SubscribeAll(func(e eventbus.Event) error {
+		handled[e.ID]++
+		return nil
+	})
+	bus.Subscribe(model.EventMessageStored, func(e eventbus.Event) error {
+		switch e.ID {
+		case "failing":
+			return errors.New("could not handle event")
+		case "panicking":
+			panic("handler bug")
+		}
+		return nil
+	})
+
+	NewRelay(store, bus, config.Config{RequestTimeout: time.Second}).drain()
+
+	if !store.published["ok"] {
+		t.Error("handled entry was not marked as published")
+	}
+	if store.published["failing"] || store.published["panicking"] {
+		t.Error("entry which a handler failed to handle was marked as published")
+	}
+	for _, id := range []string{"ok", "failing", "panicking"} {
+		if handled[id] != 1 {
+			t.Errorf("entry %s was handled %d times by the other handler, want 1", id, handled[id])
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	store := &fakeStore{published: make(map[string]bool)}
+	relay := NewRelay(store, eventbus.New(), config.Config{OutboxPollInterval: time.Hour, RequestTimeout: time.Second})
+	go relay.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := relay.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relay.Stop(ctx)
+	if err != nil {
+		t.Fatalf("stopping a stopped relay failed: %v", err)
+	}
+}
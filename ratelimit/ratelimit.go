@@ -0,0 +1,77 @@
+// Package ratelimit implements token bucket rate limits
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets which have refilled are removed
+const sweepInterval = time.Minute
+
+// Limit allows Rate requests per second on average and bursts of up to Burst requests, a zero
+// rate does not limit requests
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Buckets holds a token bucket for each key, it is safe for concurrent use
+type Buckets struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New returns empty buckets
+func New() *Buckets {
+	return &Buckets{buckets: make(map[string]*bucket)}
+}
+
+// Take takes a token from the bucket of the key, if the bucket is empty it returns false and how
+// long it takes until the next token is available
+func (bs *Buckets) Take(key string, limit Limit, now time.Time) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := math.Max(float64(limit.Burst), 1)
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.sweep(now)
+	b, ok := bs.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		bs.buckets[key] = b
+	}
+
+	// Refill the tokens for the time since the last request
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// sweep removes the buckets which have not been used for a sweep interval, a bucket refills
+// within that time unless its rate is very low, in which case it starts over with a full bucket
+func (bs *Buckets) sweep(now time.Time) {
+	if now.Sub(bs.lastSweep) < sweepInterval {
+		return
+	}
+	bs.lastSweep = now
+	for key, b := range bs.buckets {
+		if now.Sub(b.last) >= sweepInterval {
+			delete(bs.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeBurst(t *testing.T) {
+	bs := New()
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := bs.Take("a", limit, now)
+		if !ok {
+			t.Fatalf("request %d of the burst was limited", i)
+		}
+	}
+
+	ok, retryAfter := bs.Take("a", limit, now)
+	if ok {
+		t.Fatal("request over the burst was allowed")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("retry after is %v, want 500ms", retryAfter)
+	}
+}
+
+func TestTakeRefill(t *testing.T) {
+	bs := New()
+	limit := Limit{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	bs.Take("a", limit, now)
+	ok, retryAfter := bs.Take("a", limit, now.Add(250*time.Millisecond))
+	if ok {
+		t.Fatal("request before the refill was allowed")
+	}
+	if retryAfter != 750*time.Millisecond {
+		t.Errorf("retry after is %v, want 750ms", retryAfter)
+	}
+
+	ok, _ = bs.Take("a", limit, now.Add(time.Second))
+	if !ok {
+		t.Fatal("request after the refill was limited")
+	}
+}
+
+func TestTakeKeys(t *testing.T) {
+	bs := New()
+	limit := Limit{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	bs.Take("a", limit, now)
+	ok, _ := bs.Take("b", limit, now)
+	if !ok {
+		t.Fatal("request of another key was limited")
+	}
+}
+
+func TestTakeUnlimited(t *testing.T) {
+	bs := New()
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		ok, _ := bs.Take("a", Limit{}, now)
+		if !ok {
+			t.Fatal("request without a rate was limited")
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	bs := New()
+	limit := Limit{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	bs.Take("a", limit, now)
+	bs.Take("b", limit, now.Add(sweepInterval))
+	if _, ok := bs.buckets["a"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := bs.buckets["b"]; !ok {
+		t.Error("used bucket was swept")
+	}
+}
@@ -4,40 +4,64 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"time"
 
-	"github.com/shohag000/test-websocket/batman/database"
 	"github.com/shohag000/test-websocket/batman/errorcodes"
 	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/metrics"
 	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/tracing"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel/api/kv"
 )
 
 type messagingRepository struct {
-	client      *mongo.Client
-	config      config.Config
-	mongoHelper database.MongoHelper
+	client *mongo.Client
+	config config.Config
 }
 
-func (mr *messagingRepository) GetInboxByUserID(userID string, messageLimit int64) (*model.Inbox, error) {
+func (mr *messagingRepository) GetInboxByUserID(ctx context.Context, userID string, messageLimit int64) (*model.Inbox, error) {
+	ctx, end := observe(ctx, "GetInboxByUserID")
+	defer end()
+
 	// Create empty inbox
 	inbox := model.Inbox{}
 
-	// Fetch threads
-	threads, err := mr.GetAllThreadsByUserID(userID)
+	// Fetch threads, threads which cannot be decoded are left out and flag the inbox
+	var failures []error
+	threads, err := mr.GetAllThreadsByUserID(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("could not fetch threads: %v", err)
+		var partial *PartialError
+		if !errors.As(err, &partial) {
+			return nil, fmt.Errorf("could not fetch threads: %v", err)
+		}
+		failures = append(failures, partial.Errors...)
+		inbox.Incomplete = true
 	}
 
-	// Fetch messages for each threads
+	// Fetch messages for each threads, a thread whose messages cannot all be loaded is flagged
 	for _, tr := range threads {
 
-		msgs, err := mr.GetAllMessagesByThreadID(tr.ThreadID, messageLimit, 0)
+		msgs, err := mr.GetAllMessagesByThreadID(ctx, &model.GetMessagesInThreadRequest{
+			ThreadID: tr.ThreadID,
+			Limit:    int(messageLimit),
+		})
 		if err != nil {
-			continue
+			tr.MessagesIncomplete = true
+			var partial *PartialError
+			if !errors.As(err, &partial) {
+				failures = append(failures, fmt.Errorf("could not fetch messages of thread %s: %w", tr.ThreadID, err))
+				continue
+			}
+			failures = append(failures, partial.Errors...)
 		}
 
 		tr.Messages = msgs
@@ -46,38 +70,164 @@ func (mr *messagingRepository) GetInboxByUserID(userID string, messageLimit int6
 	// Add threads to inbox
 	inbox.Threads = threads
 
+	if len(failures) > 0 {
+		return &inbox, &PartialError{Errors: failures}
+	}
 	return &inbox, nil
 }
 
-func (mr *messagingRepository) StoreMessage(message *model.Message) error {
-	err := mr.mongoHelper.Store(mr.config.Database, mr.config.MessageColl, message)
+func (mr *messagingRepository) StoreMessage(ctx context.Context, message *model.Message) error {
+	ctx, end := observe(ctx, "StoreMessage")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.ThreadColl)
+
+	// Check for a resent message before assigning a seq, the unique index catches concurrent resends
+	if message.ClientMessageID != "" {
+		_, err := mr.FindMessageByClientID(ctx, message.SenderID, message.ClientMessageID)
+		if err == nil {
+			return ErrDuplicateMessage
+		}
+		if !errors.Is(err, errorcodes.ErrNotFound) {
+			return err
+		}
+	}
+
+	// Assign the seq, store the message and its outbox entry together
+	err := mr.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		var thread model.Thread
+		err := collection.FindOneAndUpdate(sc,
+			bson.M{"threadId": message.ThreadID},
+			bson.M{
+				"$inc": bson.M{"lastSeq": int64(1)},
+				"$set": bson.M{"updatedAt": message.CreatedAt},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&thread)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return errorcodes.ErrNotFound
+			}
+			return fmt.Errorf("could not assign message seq: %v", err)
+		}
+		message.Seq = thread.LastSeq
+
+		_, err = mr.client.Database(mr.config.Database).Collection(mr.config.MessageColl).InsertOne(sc, message)
+		if err != nil {
+			return err
+		}
+
+		return mr.storeOutboxEntry(sc, &model.OutboxEntry{
+			Event:   model.EventMessageStored,
+			Message: message,
+		})
+	})
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateMessage
+		}
 		return err
 	}
 
 	return nil
 }
 
-func (mr *messagingRepository) StoreThread(thread *model.Thread) error {
-	err := mr.mongoHelper.Store(mr.config.Database, mr.config.ThreadColl, thread)
+func (mr *messagingRepository) FindMessageByClientID(ctx context.Context, senderID, clientMessageID string) (*model.Message, error) {
+	ctx, end := observe(ctx, "FindMessageByClientID")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.MessageColl)
+	filter := bson.M{
+		"senderId":        senderID,
+		"clientMessageId": clientMessageID,
+	}
+
+	msg := model.Message{}
+	err := collection.FindOne(ctx, filter).Decode(&msg)
 	if err != nil {
-		return err
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
 	}
 
-	return nil
+	return &msg, nil
 }
 
-func (mr *messagingRepository) FindThreadByUsers(uID1, uID2 string) (*model.Thread, error) {
-	// Generate users hash
-	tID, err := model.GenerateThreadIDHash(uID1, uID2)
+func (mr *messagingRepository) FindOrCreateThread(ctx context.Context, thread *model.Thread) (*model.Thread, bool, error) {
+	ctx, end := observe(ctx, "FindOrCreateThread")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.ThreadColl)
+
+	// An existing thread of the users may have an id of an earlier scheme
+	existing, err := mr.FindThreadByUsers(ctx, thread.UserID1, thread.UserID2)
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, errorcodes.ErrNotFound) {
+		return nil, false, err
+	}
+
+	// Upsert the thread, the unique threadId index makes concurrent first messages converge on one
+	// document. A missing document before the upsert means this call created the thread.
+	var stored model.Thread
+	var created bool
+	err = mr.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		created = false
+		err := collection.FindOneAndUpdate(sc,
+			bson.M{"threadId": thread.ThreadID},
+			bson.M{"$setOnInsert": bson.M{
+				"userId1":   thread.UserID1,
+				"userId2":   thread.UserID2,
+				"lastSeq":   thread.LastSeq,
+				"updatedAt": thread.UpdatedAt,
+			}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+		).Decode(&stored)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		created = true
+		stored = *thread
+		return mr.storeOutboxEntry(sc, &model.OutboxEntry{
+			Event:  model.EventThreadCreated,
+			Thread: thread,
+		})
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not generate thread id hash: %v", err)
+		if mongo.IsDuplicateKeyError(err) {
+			// A concurrent upsert inserted the thread first, it is found on the next attempt
+			logger.FromContext(ctx).Debug("thread was created concurrently", "threadId", thread.ThreadID)
+			return mr.FindOrCreateThread(ctx, thread)
+		}
+		return nil, false, err
+	}
+
+	return &stored, created, nil
+}
+
+func (mr *messagingRepository) FindThreadByUsers(ctx context.Context, uID1, uID2 string) (*model.Thread, error) {
+	ctx, end := observe(ctx, "FindThreadByUsers")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.ThreadColl)
+
+	// Match the users rather than the thread id, threads created before the current id scheme
+	// keep their old ids
+	filter := bson.M{
+		"$or": []interface{}{
+			bson.M{"userId1": uID1, "userId2": uID2},
+			bson.M{"userId1": uID2, "userId2": uID1},
+		},
 	}
 
-	// Fetch data from database
-	result := mr.mongoHelper.Fetch(mr.config.Database, mr.config.ThreadColl, tID, "threadId")
 	thread := model.Thread{}
-	err = result.Decode(&thread)
+	err := collection.FindOne(ctx, filter).Decode(&thread)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, errorcodes.ErrNotFound
@@ -88,8 +238,10 @@ func (mr *messagingRepository) FindThreadByUsers(uID1, uID2 string) (*model.Thre
 	return &thread, nil
 }
 
-func (mr *messagingRepository) GetAllThreadsByUserID(userID string) ([]*model.Thread, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+func (mr *messagingRepository) GetAllThreadsByUserID(ctx context.Context, userID string) ([]*model.Thread, error) {
+	ctx, end := observe(ctx, "GetAllThreadsByUserID")
+	defer end()
+
 	collection := mr.client.Database(mr.config.Database).Collection(mr.config.ThreadColl)
 	filter := bson.M{
 		"$or": []interface{}{
@@ -111,23 +263,36 @@ func (mr *messagingRepository) GetAllThreadsByUserID(userID string) ([]*model.Th
 		return results, err
 	}
 	defer cur.Close(ctx)
-	for cur.Next(ctx) {
+	err = decodeEach(ctx, cur, collection.Name(), func(cur *mongo.Cursor) error {
 		var elem model.Thread
 		err := cur.Decode(&elem)
 		if err != nil {
-			continue
+			return err
 		}
 		results = append(results, &elem)
-	}
+		return nil
+	})
 
-	return results, nil
+	return results, err
 }
 
-func (mr *messagingRepository) GetAllMessagesByThreadID(threadID string, limit, skip int64) ([]*model.Message, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+func (mr *messagingRepository) GetAllMessagesByThreadID(ctx context.Context, req *model.GetMessagesInThreadRequest) ([]*model.Message, error) {
+	ctx, end := observe(ctx, "GetAllMessagesByThreadID")
+	defer end()
+
 	collection := mr.client.Database(mr.config.Database).Collection(mr.config.MessageColl)
 	filter := bson.M{
-		"threadId": threadID,
+		"threadId": req.ThreadID,
+	}
+
+	// Messages stored before seqs were introduced have seq 0 and sort by creation time
+	limit, skip, order := int64(req.Limit), int64(req.Skip), -1
+	switch {
+	case req.AfterSeq > 0:
+		filter["seq"] = bson.M{"$gt": req.AfterSeq}
+		order = 1
+	case req.BeforeSeq > 0:
+		filter["seq"] = bson.M{"$lt": req.BeforeSeq}
 	}
 
 	var results []*model.Message
@@ -136,43 +301,793 @@ func (mr *messagingRepository) GetAllMessagesByThreadID(threadID string, limit,
 		Limit: &limit,
 		Skip:  &skip,
 		Sort: bson.D{
-			primitive.E{Key: "createdAt", Value: -1},
+			primitive.E{Key: "seq", Value: order},
+			primitive.E{Key: "createdAt", Value: order},
 		},
 	})
 	if err != nil {
 		return results, err
 	}
 	defer cur.Close(ctx)
-	for cur.Next(ctx) {
+	err = decodeEach(ctx, cur, collection.Name(), func(cur *mongo.Cursor) error {
+		var elem model.Message
+		err := cur.Decode(&elem)
+		if err != nil {
+			return err
+		}
+		results = append(results, &elem)
+		return nil
+	})
+
+	// Always return newest first
+	if order == 1 {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+
+	return results, err
+}
+
+func (mr *messagingRepository) FindSwapAgreementMessage(ctx context.Context, threadID, swapAgreementID string) (*model.Message, error) {
+	ctx, end := observe(ctx, "FindSwapAgreementMessage")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.MessageColl)
+	filter := bson.M{
+		"threadId":                    threadID,
+		"messageType":                 model.SwapAgreementCard,
+		"messageBody.swapAgreementId": swapAgreementID,
+	}
+
+	raw, err := collection.FindOne(ctx, filter).DecodeBytes()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
+	}
+
+	// Decode the message and its card body
+	msg := model.Message{}
+	err = bson.Unmarshal(raw, &msg)
+	if err != nil {
+		return nil, err
+	}
+	card := model.SwapAgreement{}
+	err = raw.Lookup("messageBody").Unmarshal(&card)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode swap agreement: %v", err)
+	}
+	msg.MessageBody = &card
+
+	return &msg, nil
+}
+
+func (mr *messagingRepository) UpdateSwapAgreement(ctx context.Context, msg *model.Message, from model.SwapStatus) error {
+	ctx, end := observe(ctx, "UpdateSwapAgreement")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.MessageColl)
+	card := msg.MessageBody.(*model.SwapAgreement)
+
+	// Only update the card if nobody changed its status in the meantime
+	filter := bson.M{
+		"threadId":                    msg.ThreadID,
+		"messageType":                 model.SwapAgreementCard,
+		"messageBody.swapAgreementId": card.SwapAgreementID,
+		"messageBody.status":          from,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"messageBody.status":      card.Status,
+			"messageBody.respondedBy": card.RespondedBy,
+			"messageBody.updatedAt":   card.UpdatedAt,
+		},
+	}
+
+	return mr.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		res, err := collection.UpdateOne(sc, filter, update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("%w: swap agreement status has changed", model.ErrInvalidSwapTransition)
+		}
+
+		return mr.storeOutboxEntry(sc, &model.OutboxEntry{
+			Event:   model.EventSwapAgreementUpdated,
+			Message: msg,
+		})
+	})
+}
+
+func (mr *messagingRepository) FindThreadByID(ctx context.Context, threadID string) (*model.Thread, error) {
+	ctx, end := observe(ctx, "FindThreadByID")
+	defer end()
+
+	result := mr.client.Database(mr.config.Database).Collection(mr.config.ThreadColl).FindOne(ctx, bson.M{"threadId": threadID})
+	thread := model.Thread{}
+	err := result.Decode(&thread)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &thread, nil
+}
+
+func (mr *messagingRepository) StoreAttachment(ctx context.Context, attachment *model.Attachment) error {
+	ctx, end := observe(ctx, "StoreAttachment")
+	defer end()
+
+	_, err := mr.client.Database(mr.config.Database).Collection(mr.config.AttachmentColl).InsertOne(ctx, attachment)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) FindAttachmentByID(ctx context.Context, attachmentID string) (*model.Attachment, error) {
+	ctx, end := observe(ctx, "FindAttachmentByID")
+	defer end()
+
+	result := mr.client.Database(mr.config.Database).Collection(mr.config.AttachmentColl).FindOne(ctx, bson.M{"attachmentId": attachmentID})
+	attachment := model.Attachment{}
+	err := result.Decode(&attachment)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &attachment, nil
+}
+
+func (mr *messagingRepository) SetAttachmentThread(ctx context.Context, attachmentID, threadID string) error {
+	ctx, end := observe(ctx, "SetAttachmentThread")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.AttachmentColl)
+
+	// An attachment can only ever be shared in a single thread
+	filter := bson.M{
+		"attachmentId": attachmentID,
+		"$or": []interface{}{
+			bson.M{"threadId": bson.M{"$exists": false}},
+			bson.M{"threadId": threadID},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"threadId": threadID},
+	}
+
+	res, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errorcodes.ErrNotFound
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) AppendEvent(ctx context.Context, event *model.Event) error {
+	ctx, end := observe(ctx, "AppendEvent")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.EventColl)
+
+	// Check for a republished outbox entry before assigning a seq, the unique index catches
+	// concurrent duplicates
+	if event.SourceID != "" {
+		err := collection.FindOne(ctx, bson.M{"userId": event.UserID, "sourceId": event.SourceID}).Err()
+		if err == nil {
+			return ErrDuplicateEvent
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+	}
+
+	// Assign the next seq of the user's sync log and store the event together. A failed insert
+	// does not use up the seq, and an append waits for the earlier one to commit, so the events
+	// of a user become visible in seq order without gaps.
+	err := mr.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		seq, err := mr.nextSeq(sc, "user:"+event.UserID)
+		if err != nil {
+			return fmt.Errorf("could not assign event seq: %v", err)
+		}
+		event.Seq = seq
+
+		_, err = collection.InsertOne(sc, event)
+		return err
+	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateEvent
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) GetEventsSince(ctx context.Context, userID string, seq, limit int64) ([]*model.Event, error) {
+	ctx, end := observe(ctx, "GetEventsSince")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.EventColl)
+	filter := bson.M{
+		"userId": userID,
+		"seq":    bson.M{"$gt": seq},
+	}
+
+	var results []*model.Event
+
+	cur, err := collection.Find(ctx, filter, &options.FindOptions{
+		Limit: &limit,
+		Sort: bson.D{
+			primitive.E{Key: "seq", Value: 1},
+		},
+	})
+	if err != nil {
+		return results, err
+	}
+	defer cur.Close(ctx)
+	err = decodeEach(ctx, cur, collection.Name(), func(cur *mongo.Cursor) error {
+		var elem model.Event
+		err := cur.Decode(&elem)
+		if err != nil {
+			return err
+		}
+		results = append(results, &elem)
+		return nil
+	})
+
+	return results, err
+}
+
+func (mr *messagingRepository) GetLastEventSeq(ctx context.Context, userID string) (int64, error) {
+	ctx, end := observe(ctx, "GetLastEventSeq")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.CounterColl)
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := collection.FindOne(ctx, bson.M{"_id": "user:" + userID}).Decode(&counter)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return counter.Seq, nil
+}
+
+// nextSeq atomically increments and returns the counter stored under key
+func (mr *messagingRepository) nextSeq(ctx context.Context, key string) (int64, error) {
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.CounterColl)
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"seq": int64(1)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Seq, nil
+}
+
+func (mr *messagingRepository) StoreDevice(ctx context.Context, device *model.Device) error {
+	ctx, end := observe(ctx, "StoreDevice")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.DeviceColl)
+
+	// A device token belongs to the user who registered it last
+	_, err := collection.ReplaceOne(ctx,
+		bson.M{"token": device.Token},
+		device,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) GetDevicesByUserID(ctx context.Context, userID string) ([]*model.Device, error) {
+	ctx, end := observe(ctx, "GetDevicesByUserID")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.DeviceColl)
+
+	var results []*model.Device
+
+	cur, err := collection.Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return results, err
+	}
+	defer cur.Close(ctx)
+	err = decodeEach(ctx, cur, collection.Name(), func(cur *mongo.Cursor) error {
+		var elem model.Device
+		err := cur.Decode(&elem)
+		if err != nil {
+			return err
+		}
+		results = append(results, &elem)
+		return nil
+	})
+
+	return results, err
+}
+
+func (mr *messagingRepository) DeleteDevice(ctx context.Context, token string) error {
+	ctx, end := observe(ctx, "DeleteDevice")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.DeviceColl)
+
+	_, err := collection.DeleteOne(ctx, bson.M{"token": token})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) SetThreadMuted(ctx context.Context, threadID, userID string, muted bool) error {
+	ctx, end := observe(ctx, "SetThreadMuted")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.ThreadColl)
+
+	update := bson.M{"$pull": bson.M{"mutedBy": userID}}
+	if muted {
+		update = bson.M{"$addToSet": bson.M{"mutedBy": userID}}
+	}
+
+	res, err := collection.UpdateOne(ctx, bson.M{"threadId": threadID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errorcodes.ErrNotFound
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) TouchUser(ctx context.Context, userID string, seenAt time.Time) error {
+	ctx, end := observe(ctx, "TouchUser")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.UserColl)
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"userId": userID},
+		bson.M{"$set": bson.M{"lastSeenAt": seenAt}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) GetUserSettings(ctx context.Context, userID string) (*model.UserSettings, error) {
+	ctx, end := observe(ctx, "GetUserSettings")
+	defer end()
+
+	result := mr.client.Database(mr.config.Database).Collection(mr.config.UserColl).FindOne(ctx, bson.M{"userId": userID})
+	settings := model.UserSettings{}
+	err := result.Decode(&settings)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+func (mr *messagingRepository) UpdateUserSettings(ctx context.Context, settings *model.UserSettings) error {
+	ctx, end := observe(ctx, "UpdateUserSettings")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.UserColl)
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"userId": settings.UserID},
+		bson.M{"$set": bson.M{
+			"email":        settings.Email,
+			"digestOptOut": settings.DigestOptOut,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) GetDigestCandidates(ctx context.Context, seenBefore, digestBefore time.Time) ([]*model.UserSettings, error) {
+	ctx, end := observe(ctx, "GetDigestCandidates")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.UserColl)
+	filter := bson.M{
+		"email":        bson.M{"$gt": ""},
+		"digestOptOut": bson.M{"$ne": true},
+		"lastSeenAt":   bson.M{"$lt": seenBefore},
+		"$or": []interface{}{
+			bson.M{"lastDigestAt": bson.M{"$exists": false}},
+			bson.M{"lastDigestAt": bson.M{"$lt": digestBefore}},
+		},
+	}
+
+	var results []*model.UserSettings
+
+	cur, err := collection.Find(ctx, filter)
+	if err != nil {
+		return results, err
+	}
+	defer cur.Close(ctx)
+	err = decodeEach(ctx, cur, collection.Name(), func(cur *mongo.Cursor) error {
+		var elem model.UserSettings
+		err := cur.Decode(&elem)
+		if err != nil {
+			return err
+		}
+		results = append(results, &elem)
+		return nil
+	})
+
+	return results, err
+}
+
+func (mr *messagingRepository) GetUnreadMessages(ctx context.Context, userID string, since time.Time, limit int64) ([]*model.Message, error) {
+	ctx, end := observe(ctx, "GetUnreadMessages")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.MessageColl)
+	filter := bson.M{
+		"receiverId": userID,
+		"senderId":   bson.M{"$ne": userID},
+		"createdAt":  bson.M{"$gt": since},
+	}
+
+	var results []*model.Message
+
+	cur, err := collection.Find(ctx, filter, &options.FindOptions{
+		Limit: &limit,
+		Sort: bson.D{
+			primitive.E{Key: "createdAt", Value: 1},
+		},
+	})
+	if err != nil {
+		return results, err
+	}
+	defer cur.Close(ctx)
+	err = decodeEach(ctx, cur, collection.Name(), func(cur *mongo.Cursor) error {
 		var elem model.Message
 		err := cur.Decode(&elem)
 		if err != nil {
-			continue
+			return err
 		}
 		results = append(results, &elem)
+		return nil
+	})
+
+	return results, err
+}
+
+func (mr *messagingRepository) ClaimDigest(ctx context.Context, userID string, digestBefore, sentAt time.Time) (bool, error) {
+	ctx, end := observe(ctx, "ClaimDigest")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.UserColl)
+
+	// Only one of the instances which found the user as a candidate updates the document
+	result, err := collection.UpdateOne(ctx,
+		bson.M{
+			"userId": userID,
+			"$or": []interface{}{
+				bson.M{"lastDigestAt": bson.M{"$exists": false}},
+				bson.M{"lastDigestAt": bson.M{"$lt": digestBefore}},
+			},
+		},
+		bson.M{"$set": bson.M{"lastDigestAt": sentAt}},
+	)
+	if err != nil {
+		return false, err
 	}
 
-	return results, nil
+	return result.ModifiedCount == 1, nil
+}
+
+func (mr *messagingRepository) ReleaseDigest(ctx context.Context, userID string, sentAt, lastDigestAt time.Time) error {
+	ctx, end := observe(ctx, "ReleaseDigest")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.UserColl)
+
+	update := bson.M{"$set": bson.M{"lastDigestAt": lastDigestAt}}
+	if lastDigestAt.IsZero() {
+		update = bson.M{"$unset": bson.M{"lastDigestAt": ""}}
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"userId": userID, "lastDigestAt": sentAt}, update)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) StoreWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error {
+	ctx, end := observe(ctx, "StoreWebhookDelivery")
+	defer end()
+
+	_, err := mr.client.Database(mr.config.Database).Collection(mr.config.WebhookDeliveryColl).InsertOne(ctx, delivery)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) StoreWebhookDeadLetter(ctx context.Context, deadLetter *model.WebhookDeadLetter) error {
+	ctx, end := observe(ctx, "StoreWebhookDeadLetter")
+	defer end()
+
+	_, err := mr.client.Database(mr.config.Database).Collection(mr.config.WebhookDeadLetterColl).InsertOne(ctx, deadLetter)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) ClaimOutboxEntry(ctx context.Context, lease time.Duration) (*model.OutboxEntry, error) {
+	ctx, end := observe(ctx, "ClaimOutboxEntry")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.OutboxColl)
+
+	// Claim the oldest entry which is neither published nor claimed by another relay
+	now := time.Now()
+	var entry model.OutboxEntry
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{
+			"publishedAt": nil,
+			"lockedUntil": bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"lockedUntil": now.Add(lease)}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{primitive.E{Key: "createdAt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&entry)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (mr *messagingRepository) MarkOutboxPublished(ctx context.Context, entryID string) error {
+	ctx, end := observe(ctx, "MarkOutboxPublished")
+	defer end()
+
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.OutboxColl)
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": entryID},
+		bson.M{"$set": bson.M{"publishedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *messagingRepository) WatchOutbox(ctx context.Context) (<-chan struct{}, error) {
+	collection := mr.client.Database(mr.config.Database).Collection(mr.config.OutboxColl)
+
+	stream, err := collection.Watch(ctx, mongo.Pipeline{
+		bson.D{primitive.E{Key: "$match", Value: bson.M{"operationType": "insert"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Signal without blocking, a pending signal already covers any later inserts
+	inserted := make(chan struct{}, 1)
+	go func() {
+		defer close(inserted)
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			select {
+			case inserted <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return inserted, nil
+}
+
+// Ping checks that the primary can be reached
+func (mr *messagingRepository) Ping(ctx context.Context) error {
+	return mr.client.Ping(ctx, readpref.Primary())
+}
+
+// decodeEach calls decode for every document of the cursor. Documents which cannot be decoded are
+// counted and skipped, they are reported in a PartialError after the other documents are decoded.
+func decodeEach(ctx context.Context, cur *mongo.Cursor, collection string, decode func(cur *mongo.Cursor) error) error {
+	var failures []error
+	for cur.Next(ctx) {
+		err := decode(cur)
+		if err != nil {
+			metrics.CorruptDocuments.WithLabelValues(collection).Inc()
+			decodeErr := &DecodeError{
+				Collection: collection,
+				DocumentID: documentID(cur.Current),
+				Err:        err,
+			}
+			logger.FromContext(ctx).Warn("could not decode document", "collection", collection, "documentId", decodeErr.DocumentID, "error", err)
+			failures = append(failures, decodeErr)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	if len(failures) > 0 {
+		return &PartialError{Errors: failures}
+	}
+	return nil
+}
+
+// documentID returns the _id of the raw document as a string
+func documentID(doc bson.Raw) string {
+	id, err := doc.LookupErr("_id")
+	if err != nil {
+		return ""
+	}
+	if oid, ok := id.ObjectIDOK(); ok {
+		return oid.Hex()
+	}
+	if str, ok := id.StringValueOK(); ok {
+		return str
+	}
+	return id.String()
+}
+
+// storeOutboxEntry adds the entry to the outbox within the transaction of the change it describes
+func (mr *messagingRepository) storeOutboxEntry(sc mongo.SessionContext, entry *model.OutboxEntry) error {
+	entry.EntryID = primitive.NewObjectID().Hex()
+	entry.CreatedAt = time.Now()
+	entry.LockedUntil = entry.CreatedAt
+	entry.TraceParent = tracing.TraceParent(sc)
+
+	_, err := mr.client.Database(mr.config.Database).Collection(mr.config.OutboxColl).InsertOne(sc, entry)
+	if err != nil {
+		return fmt.Errorf("could not store outbox entry: %v", err)
+	}
+
+	return nil
+}
+
+// withTransaction runs fn in a transaction, fn may be retried on transient errors. Transactions
+// require mongo to run as a replica set.
+func (mr *messagingRepository) withTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := mr.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("could not start session: %v", err)
+	}
+	defer session.EndSession(ctx)
+
+	attempt := 0
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		attempt++
+		if attempt > 1 {
+			logger.FromContext(ctx).Debug("retrying transaction", "attempt", attempt)
+		}
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// observe starts the span of a repository call, the returned function ends it and records the
+// latency of the call
+func observe(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "repository."+method, kv.String("db.system", "mongodb"))
+	return ctx, func() {
+		span.End()
+		metrics.ObserveRepository(method, start)
+	}
 }
 
 // NewMongoRepository returns a new mongo messaging repository
 func NewMongoRepository(dbClient *mongo.Client) MessagingRepository {
-	mHelper := database.NewMongoHelper(dbClient)
 	return &messagingRepository{
-		client:      dbClient,
-		config:      config.New(),
-		mongoHelper: mHelper,
+		client: dbClient,
+		config: config.New(),
 	}
 }
 
-// GetDBClient returns a mongo client
-func GetDBClient() (*mongo.Client, error) {
-	cs := "mongodb://mongo:27017"
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cs))
+// NewRegistry returns the bson registry of the client, it decodes untyped embedded documents such
+// as message bodies to maps so that they are sent to clients as json objects
+func NewRegistry() *bsoncodec.Registry {
+	return bson.NewRegistryBuilder().
+		RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(bson.M{})).
+		Build()
+}
+
+// minWireVersion is the wire version of MongoDB 4.4, the first version which creates collections
+// inside transactions
+const minWireVersion = 9
+
+// GetDBClient returns a mongo client of the configured deployment. It fails if the deployment does
+// not support transactions and change streams, which need a replica set or a sharded cluster.
+func GetDBClient(cfg config.Config) (*mongo.Client, error) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cfg.MongoURI).SetRegistry(NewRegistry()))
 	if err != nil {
 		return nil, err
 	}
 	// defer client.Disconnect(ctx)
 
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+	err = checkTransactions(ctx, client)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
 	return client, nil
 }
+
+// checkTransactions returns an error if the deployment of the client does not support
+// transactions
+func checkTransactions(ctx context.Context, client *mongo.Client) error {
+	var hello struct {
+		SetName        string `bson:"setName"`
+		Msg            string `bson:"msg"`
+		MaxWireVersion int32  `bson:"maxWireVersion"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{primitive.E{Key: "isMaster", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return fmt.Errorf("could not reach mongodb: %v", err)
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return errors.New("mongodb is a standalone server, transactions need a replica set or a sharded cluster, see MONGO_URI in the README")
+	}
+	if hello.MaxWireVersion < minWireVersion {
+		return errors.New("mongodb 4.4 or later is required")
+	}
+	return nil
+}
@@ -1,13 +1,96 @@
 package repository
 
-import "github.com/shohag000/test-websocket/model"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shohag000/test-websocket/model"
+)
+
+var (
+	// ErrDuplicateMessage is returned when a message with the same client message id was already stored
+	ErrDuplicateMessage = errors.New("duplicate message")
+	// ErrDuplicateEvent is returned when an outbox entry was already recorded in the user's sync log
+	ErrDuplicateEvent = errors.New("duplicate event")
+)
+
+// DecodeError is the error of a document which could not be decoded into its model
+type DecodeError struct {
+	Collection string
+	DocumentID string
+	Err        error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode %s document '%s': %v", e.Collection, e.DocumentID, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned together with the results which could be loaded when some parts of
+// them could not, such as documents which failed to decode
+type PartialError struct {
+	Errors []error
+}
+
+func (e *PartialError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d parts could not be loaded: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// DocumentIDs returns the ids of the documents which could not be decoded
+func (e *PartialError) DocumentIDs() []string {
+	var ids []string
+	for _, err := range e.Errors {
+		var de *DecodeError
+		if errors.As(err, &de) {
+			ids = append(ids, de.DocumentID)
+		}
+	}
+	return ids
+}
 
 // MessagingRepository defines the messaging repository
 type MessagingRepository interface {
-	GetInboxByUserID(userID string, messageLimit int64) (*model.Inbox, error)
-	StoreMessage(message *model.Message) error
-	StoreThread(thread *model.Thread) error
-	FindThreadByUsers(userID, otherUserID string) (*model.Thread, error)
-	GetAllThreadsByUserID(userID string) ([]*model.Thread, error)
-	GetAllMessagesByThreadID(threadID string, limit, skip int64) ([]*model.Message, error)
+	GetInboxByUserID(ctx context.Context, userID string, messageLimit int64) (*model.Inbox, error)
+	StoreMessage(ctx context.Context, message *model.Message) error
+	FindMessageByClientID(ctx context.Context, senderID, clientMessageID string) (*model.Message, error)
+	FindOrCreateThread(ctx context.Context, thread *model.Thread) (stored *model.Thread, created bool, err error)
+	FindThreadByUsers(ctx context.Context, userID, otherUserID string) (*model.Thread, error)
+	GetAllThreadsByUserID(ctx context.Context, userID string) ([]*model.Thread, error)
+	GetAllMessagesByThreadID(ctx context.Context, req *model.GetMessagesInThreadRequest) ([]*model.Message, error)
+	FindSwapAgreementMessage(ctx context.Context, threadID, swapAgreementID string) (*model.Message, error)
+	UpdateSwapAgreement(ctx context.Context, msg *model.Message, from model.SwapStatus) error
+	FindThreadByID(ctx context.Context, threadID string) (*model.Thread, error)
+	StoreAttachment(ctx context.Context, attachment *model.Attachment) error
+	FindAttachmentByID(ctx context.Context, attachmentID string) (*model.Attachment, error)
+	SetAttachmentThread(ctx context.Context, attachmentID, threadID string) error
+	AppendEvent(ctx context.Context, event *model.Event) error
+	GetEventsSince(ctx context.Context, userID string, seq, limit int64) ([]*model.Event, error)
+	GetLastEventSeq(ctx context.Context, userID string) (int64, error)
+	StoreDevice(ctx context.Context, device *model.Device) error
+	GetDevicesByUserID(ctx context.Context, userID string) ([]*model.Device, error)
+	DeleteDevice(ctx context.Context, token string) error
+	SetThreadMuted(ctx context.Context, threadID, userID string, muted bool) error
+	TouchUser(ctx context.Context, userID string, seenAt time.Time) error
+	GetUserSettings(ctx context.Context, userID string) (*model.UserSettings, error)
+	UpdateUserSettings(ctx context.Context, settings *model.UserSettings) error
+	GetDigestCandidates(ctx context.Context, seenBefore, digestBefore time.Time) ([]*model.UserSettings, error)
+	GetUnreadMessages(ctx context.Context, userID string, since time.Time, limit int64) ([]*model.Message, error)
+	ClaimDigest(ctx context.Context, userID string, digestBefore, sentAt time.Time) (bool, error)
+	ReleaseDigest(ctx context.Context, userID string, sentAt, lastDigestAt time.Time) error
+	StoreWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error
+	StoreWebhookDeadLetter(ctx context.Context, deadLetter *model.WebhookDeadLetter) error
+	ClaimOutboxEntry(ctx context.Context, lease time.Duration) (*model.OutboxEntry, error)
+	MarkOutboxPublished(ctx context.Context, entryID string) error
+	WatchOutbox(ctx context.Context) (<-chan struct{}, error)
+	Ping(ctx context.Context) error
 }
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+)
+
+type localStore struct {
+	dir string
+}
+
+func (ls *localStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (ls *localStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errorcodes.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (ls *localStore) Delete(ctx context.Context, key string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// path resolves the key to a file inside the store directory
+func (ls *localStore) path(key string) (string, error) {
+	path := filepath.Join(ls.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, ls.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key '%s'", key)
+	}
+	return path, nil
+}
+
+// NewLocalStore returns a blob store which keeps objects on the local filesystem
+func NewLocalStore(dir string) (BlobStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create blob directory: %v", err)
+	}
+
+	return &localStore{dir: dir}, nil
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/shohag000/test-websocket/config"
+)
+
+// BlobStore defines a store for binary objects such as attachments
+type BlobStore interface {
+	// Put stores the content of r under key
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key, it returns errorcodes.ErrNotFound if there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the blob store selected in the config
+func New(cfg config.Config) (BlobStore, error) {
+	switch cfg.BlobStore {
+	case "local":
+		return NewLocalStore(cfg.LocalBlobDir)
+	case "s3":
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob store '%s'", cfg.BlobStore)
+	}
+}
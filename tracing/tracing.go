@@ -0,0 +1,148 @@
+// Package tracing sets up opentelemetry tracing of websocket requests, service and repository
+// calls and propagates trace context in w3c traceparent format
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+const instrumentationName = "github.com/shohag000/test-websocket"
+
+// Setup installs the global trace provider which exports spans to the OTLP collector, tracing is
+// disabled without a collector endpoint. The returned function exports the spans which are still
+// batched and closes the connection to the collector, it is called before the process exits.
+func Setup(cfg config.Config) (func(), error) {
+	if cfg.OTLPEndpoint == "" {
+		return func() {}, nil
+	}
+
+	opts := []otlp.ExporterOption{otlp.WithAddress(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		opts = append(opts, otlp.WithInsecure())
+	}
+	exporter, err := otlp.NewExporter(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create otlp exporter: %v", err)
+	}
+	batcher, err := sdktrace.NewBatchSpanProcessor(exporter)
+	if err != nil {
+		exporter.Stop()
+		return nil, fmt.Errorf("could not create span batcher: %v", err)
+	}
+
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(cfg.TraceSampleRatio)}),
+		sdktrace.WithResource(resource.New(kv.String("service.name", cfg.ServiceName))),
+	)
+	if err != nil {
+		exporter.Stop()
+		return nil, fmt.Errorf("could not create trace provider: %v", err)
+	}
+	provider.RegisterSpanProcessor(batcher)
+	global.SetTraceProvider(provider)
+
+	return func() {
+		// Unregistering the batcher exports its queue
+		provider.UnregisterSpanProcessor(batcher)
+		err := exporter.Stop()
+		if err != nil {
+			logger.Default().Error("could not stop span exporter", "error", err)
+		}
+	}, nil
+}
+
+// Use installs a global trace provider which samples every span and exports it synchronously to
+// the exporter, such as a MemoryExporter in tests
+func Use(exporter export.SpanSyncer) error {
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create trace provider: %v", err)
+	}
+	global.SetTraceProvider(provider)
+	return nil
+}
+
+// Start starts a span which is a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// RecordError records err on the span in ctx and marks the span as failed
+func RecordError(ctx context.Context, err error, attrs ...kv.KeyValue) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(ctx, err, trace.WithErrorStatus(codes.Unknown))
+	span.SetAttributes(attrs...)
+}
+
+// carrier holds propagated trace headers
+type carrier map[string]string
+
+func (c carrier) Get(key string) string {
+	return c[key]
+}
+
+func (c carrier) Set(key, value string) {
+	c[key] = value
+}
+
+// TraceParent returns the traceparent of the span in ctx, it is empty without a span
+func TraceParent(ctx context.Context) string {
+	c := carrier{}
+	trace.TraceContext{}.Inject(ctx, c)
+	return c["traceparent"]
+}
+
+// WithTraceParent returns a context whose spans are children of the remote span of the
+// traceparent, an empty or invalid traceparent returns ctx
+func WithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	return trace.TraceContext{}.Extract(ctx, carrier{"traceparent": traceParent})
+}
+
+// MemoryExporter keeps exported spans in memory
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+// ExportSpan keeps the span
+func (e *MemoryExporter) ExportSpan(ctx context.Context, span *export.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the exported spans in the order they ended
+func (e *MemoryExporter) Spans() []*export.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]*export.SpanData(nil), e.spans...)
+}
+
+// Reset forgets the exported spans
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = nil
+}
@@ -0,0 +1,321 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+)
+
+// errShutDown is returned for events which arrive after the dispatcher shut down
+var errShutDown = errors.New("webhook dispatcher is shut down")
+
+// Store defines where the dispatcher records delivery attempts and failed deliveries
+type Store interface {
+	StoreWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error
+	StoreWebhookDeadLetter(ctx context.Context, deadLetter *model.WebhookDeadLetter) error
+}
+
+// Payload is the json body posted to a webhook endpoint
+type Payload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// delivery is a payload on its way to one subscription
+type delivery struct {
+	id           string
+	event        string
+	subscription config.WebhookSubscription
+	body         []byte
+	attempt      int
+	lastError    string
+}
+
+// queueSize is the number of deliveries waiting for a worker
+const queueSize = 1024
+
+// Dispatcher posts signed event payloads to the subscribed endpoints. Failed deliveries are
+// retried with exponential backoff and stored as dead letters once all attempts are used up.
+// Retries wait in memory: a shutdown stores the deliveries waiting for a retry as dead letters,
+// a crash loses them.
+type Dispatcher struct {
+	store         Store
+	client        *http.Client
+	subscriptions []config.WebhookSubscription
+	maxAttempts   int
+	retryDelay    time.Duration
+	timeout       time.Duration
+	jobs          chan *delivery
+	workers       sync.WaitGroup
+
+	// Deliveries waiting for their retry, and the senders to the job queue which is closed on
+	// shutdown once they are done
+	mu      sync.Mutex
+	retries map[*delivery]*time.Timer
+	sending sync.WaitGroup
+	closed  bool
+}
+
+// HandleEvent queues the event for every subscription which listens to it. The payload id is
+// the event id, so receivers can drop events which are delivered more than once. If the queue
+// stays full for the request timeout the event fails, and the outbox publishes it again later.
+func (d *Dispatcher) HandleEvent(e eventbus.Event) error {
+	payload := Payload{
+		ID:        e.ID,
+		Event:     e.Name,
+		CreatedAt: time.Now().UTC(),
+		Data:      e.Data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Default().Error("could not encode webhook payload", "event", e.Name, "eventId", e.ID, "error", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	for _, sub := range d.subscriptions {
+		if !subscribed(sub, e.Name) {
+			continue
+		}
+		err = d.enqueue(ctx, &delivery{
+			id:           payload.ID,
+			event:        e.Name,
+			subscription: sub,
+			body:         body,
+		})
+		if err != nil {
+			return fmt.Errorf("could not queue webhook delivery for %s: %w", sub.ID, err)
+		}
+	}
+	return nil
+}
+
+// enqueue waits until the queue has room for the delivery or the context is done
+func (d *Dispatcher) enqueue(ctx context.Context, dl *delivery) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return errShutDown
+	}
+	d.sending.Add(1)
+	d.mu.Unlock()
+	defer d.sending.Done()
+
+	select {
+	case d.jobs <- dl:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhook queue is full: %w", ctx.Err())
+	}
+}
+
+// retry queues the delivery again after the backoff of its attempt, a delivery which fails while
+// the dispatcher shuts down is dead lettered instead
+func (d *Dispatcher) retry(dl *delivery) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		d.deadLetter(dl)
+		return
+	}
+	backoff := d.retryDelay << uint(dl.attempt-1)
+	d.retries[dl] = time.AfterFunc(backoff, func() {
+		d.mu.Lock()
+		if d.closed {
+			// Shutdown dead letters the delivery
+			d.mu.Unlock()
+			return
+		}
+		delete(d.retries, dl)
+		d.sending.Add(1)
+		d.mu.Unlock()
+
+		// The workers keep taking deliveries until the senders are done
+		d.jobs <- dl
+		d.sending.Done()
+	})
+	d.mu.Unlock()
+}
+
+// Shutdown dead letters the deliveries waiting for a retry, so they can be replayed from the
+// dead letter collection, and waits until the queued deliveries are sent or the context is done
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	retries := d.retries
+	d.retries = nil
+	d.mu.Unlock()
+
+	for dl, timer := range retries {
+		timer.Stop()
+		dl.lastError = "webhook dispatcher shut down before retry: " + dl.lastError
+		d.deadLetter(dl)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.sending.Wait()
+		close(d.jobs)
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhook deliveries were not sent: %v", ctx.Err())
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for dl := range d.jobs {
+		d.deliver(dl)
+	}
+}
+
+func (d *Dispatcher) deliver(dl *delivery) {
+	dl.attempt++
+	start := time.Now()
+	status, err := d.post(dl)
+	record := &model.WebhookDelivery{
+		DeliveryID:     dl.id,
+		SubscriptionID: dl.subscription.ID,
+		Event:          dl.event,
+		Attempt:        dl.attempt,
+		StatusCode:     status,
+		DurationMS:     int64(time.Since(start) / time.Millisecond),
+		CreatedAt:      start.UTC(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	if storeErr := d.store.StoreWebhookDelivery(ctx, record); storeErr != nil {
+		logger.Default().Error("could not store webhook delivery", "error", storeErr)
+	}
+	if err == nil {
+		return
+	}
+
+	dl.lastError = err.Error()
+	if dl.attempt >= d.maxAttempts {
+		d.deadLetter(dl)
+		return
+	}
+	d.retry(dl)
+}
+
+// post sends the delivery and returns the response status, any status other than 2xx is an error
+func (d *Dispatcher) post(dl *delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.subscription.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", dl.id)
+	req.Header.Set("X-Webhook-Event", dl.event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(dl.subscription.Secret, timestamp, dl.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) deadLetter(dl *delivery) {
+	logger.Default().Warn("giving up webhook", "webhookId", dl.id, "subscription", dl.subscription.ID, "attempts", dl.attempt, "error", dl.lastError)
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	err := d.store.StoreWebhookDeadLetter(ctx, &model.WebhookDeadLetter{
+		DeliveryID:     dl.id,
+		SubscriptionID: dl.subscription.ID,
+		URL:            dl.subscription.URL,
+		Event:          dl.event,
+		Payload:        string(dl.body),
+		Attempts:       dl.attempt,
+		LastError:      dl.lastError,
+		CreatedAt:      time.Now().UTC(),
+	})
+	if err != nil {
+		logger.Default().Error("could not store webhook dead letter", "webhookId", dl.id, "error", err)
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp and body joined by a dot,
+// receivers recompute it with their secret to verify the X-Webhook-Signature header
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribed(sub config.WebhookSubscription, event string) bool {
+	if len(sub.Events) == 0 {
+		return true
+	}
+	for _, e := range sub.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDispatcher returns a dispatcher for the configured subscriptions which delivers from
+// the configured number of workers
+func NewDispatcher(store Store, cfg config.Config) *Dispatcher {
+	d := &Dispatcher{
+		store:         store,
+		client:        &http.Client{Timeout: 15 * time.Second},
+		subscriptions: cfg.Webhooks,
+		maxAttempts:   cfg.WebhookMaxAttempts,
+		retryDelay:    cfg.WebhookRetryDelay,
+		timeout:       cfg.RequestTimeout,
+		jobs:          make(chan *delivery, queueSize),
+		retries:       make(map[*delivery]*time.Timer),
+	}
+	d.workers.Add(cfg.WebhookWorkers)
+	for i := 0; i < cfg.WebhookWorkers; i++ {
+		go d.work()
+	}
+	return d
+}
@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/model"
+)
+
+// fakeStore records delivery attempts and dead letters in memory
+type fakeStore struct {
+	mu          sync.Mutex
+	deliveries  []*model.WebhookDelivery
+	deadLetters []*model.WebhookDeadLetter
+}
+
+func (fs *fakeStore) StoreWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.deliveries = append(fs.deliveries, delivery)
+	return nil
+}
+
+func (fs *fakeStore) StoreWebhookDeadLetter(ctx context.Context, deadLetter *model.WebhookDeadLetter) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.deadLetters = append(fs.deadLetters, deadLetter)
+	return nil
+}
+
+func (fs *fakeStore) DeadLetters() []*model.WebhookDeadLetter {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]*model.WebhookDeadLetter(nil), fs.deadLetters...)
+}
+
+// endpoint is a webhook receiver which fails the first requests
+type endpoint struct {
+	mu       sync.Mutex
+	failures int
+	times    []time.Time
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (ep *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.times = append(ep.times, time.Now())
+	ep.requests = append(ep.requests, r)
+	ep.bodies = append(ep.bodies, body)
+	if len(ep.times) <= ep.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (ep *endpoint) Requests() int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return len(ep.times)
+}
+
+func newTestDispatcher(store Store, url string, maxAttempts int, retryDelay time.Duration) *Dispatcher {
+	return NewDispatcher(store, config.Config{
+		Webhooks:           []config.WebhookSubscription{{ID: "sub", URL: url, Secret: "secret"}},
+		WebhookMaxAttempts: maxAttempts,
+		WebhookRetryDelay:  retryDelay,
+		WebhookWorkers:     1,
+		RequestTimeout:     time.Second,
+	})
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	ep := &endpoint{}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+	d := newTestDispatcher(&fakeStore{}, server.URL, 1, time.Millisecond)
+
+	err := d.HandleEvent(eventbus.Event{ID: "event", Name: model.EventMessageStored, Data: map[string]string{"text": "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return ep.Requests() == 1 })
+
+	r, body := ep.requests[0], ep.bodies[0]
+	if r.Header.Get("X-Webhook-ID") != "event" || r.Header.Get("X-Webhook-Event") != model.EventMessageStored {
+		t.Errorf("headers are %v", r.Header)
+	}
+	want := "sha256=" + Sign("secret", r.Header.Get("X-Webhook-Timestamp"), body)
+	if !hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte(want)) {
+		t.Errorf("signature is %s, want %s", r.Header.Get("X-Webhook-Signature"), want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	ep := &endpoint{failures: 2}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+	delay := 20 * time.Millisecond
+	store := &fakeStore{}
+	d := newTestDispatcher(store, server.URL, 5, delay)
+
+	d.HandleEvent(eventbus.Event{ID: "event", Name: model.EventMessageStored})
+	waitFor(t, "the retries", func() bool { return ep.Requests() == 3 })
+
+	// The delay doubles on each attempt
+	for i, want := range []time.Duration{delay, 2 * delay} {
+		if got := ep.times[i+1].Sub(ep.times[i]); got < want {
+			t.Errorf("retry %d came after %v, want at least %v", i+1, got, want)
+		}
+	}
+	if n := len(store.DeadLetters()); n != 0 {
+		t.Errorf("stored %d dead letters of a delivery which succeeded", n)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	ep := &endpoint{failures: 100}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+	store := &fakeStore{}
+	d := newTestDispatcher(store, server.URL, 3, time.Millisecond)
+
+	d.HandleEvent(eventbus.Event{ID: "event", Name: model.EventMessageStored})
+	waitFor(t, "the dead letter", func() bool { return len(store.DeadLetters()) == 1 })
+
+	dl := store.DeadLetters()[0]
+	if dl.Attempts != 3 || dl.DeliveryID != "event" || !strings.Contains(dl.LastError, "503") {
+		t.Errorf("dead letter is %+v", dl)
+	}
+	if n := ep.Requests(); n != 3 {
+		t.Errorf("endpoint received %d requests, want 3", n)
+	}
+}
+
+func TestFullQueueFailsTheEvent(t *testing.T) {
+	store := &fakeStore{}
+	d := NewDispatcher(store, config.Config{
+		Webhooks:       []config.WebhookSubscription{{ID: "sub", URL: "http://127.0.0.1:0"}},
+		RequestTimeout: 10 * time.Millisecond,
+	})
+
+	// Without workers the queue is not drained
+	for i := 0; i < queueSize; i++ {
+		err := d.HandleEvent(eventbus.Event{ID: "event", Name: model.EventMessageStored})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := d.HandleEvent(eventbus.Event{ID: "event", Name: model.EventMessageStored})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error is %v, want the queue deadline", err)
+	}
+	if n := len(store.DeadLetters()); n != 0 {
+		t.Errorf("stored %d dead letters of a full queue, want the event to fail instead", n)
+	}
+}
+
+func TestShutdownDeadLettersRetries(t *testing.T) {
+	ep := &endpoint{failures: 100}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+	store := &fakeStore{}
+	d := newTestDispatcher(store, server.URL, 5, time.Hour)
+
+	d.HandleEvent(eventbus.Event{ID: "event", Name: model.EventMessageStored})
+	waitFor(t, "the first attempt", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.retries) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dls := store.DeadLetters(); len(dls) != 1 || dls[0].Attempts != 1 {
+		t.Errorf("dead letters are %v, want the delivery waiting for its retry", dls)
+	}
+	if err := d.HandleEvent(eventbus.Event{ID: "late", Name: model.EventMessageStored}); !errors.Is(err, errShutDown) {
+		t.Errorf("event after the shutdown returned %v, want %v", err, errShutDown)
+	}
+}
@@ -0,0 +1,139 @@
+package ws
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+)
+
+// maxAnnouncementSize is the maximum size of an announcement request body
+const maxAnnouncementSize = 256 << 10
+
+// ConnectionInfo defines the details of a connection shown to operators
+type ConnectionInfo struct {
+	ConnectionID  string    `json:"connectionId"`
+	UserID        string    `json:"userId,omitempty"`
+	Authenticated bool      `json:"authenticated"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+	SendQueue     int       `json:"sendQueue"`
+}
+
+type adminHandler struct {
+	hub    *Hub
+	config config.Config
+}
+
+// NewAdminHandler returns the http handler of the admin api, requests must pass the admin token
+// as bearer token.
+//
+//	GET    {route}connections[?userId=]        lists the connections
+//	DELETE {route}connections/{connectionId}   closes a connection
+//	DELETE {route}users/{userId}/connections   closes the connections of a user
+//	POST   {route}announcements                sends an announcement to connected users
+func NewAdminHandler(hub *Hub, cfg config.Config) http.Handler {
+	return &adminHandler{
+		hub:    hub,
+		config: cfg,
+	}
+}
+
+func (ah *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logger.Default().With("requestId", logger.NewID(), "method", r.Method, "path", r.URL.Path)
+	ctx, cancel := context.WithTimeout(logger.NewContext(r.Context(), log), ah.config.RequestTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// Authenticate the operator
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ah.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(ah.config.AdminToken)) != 1 {
+		ah.writeError(w, r, handler.ErrInvalidToken)
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, ah.config.AdminRoute), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "connections" && r.Method == http.MethodGet:
+		ah.listConnections(w, r)
+	case len(path) == 2 && path[0] == "connections" && r.Method == http.MethodDelete:
+		ah.disconnect(w, r, path[1], "")
+	case len(path) == 3 && path[0] == "users" && path[2] == "connections" && r.Method == http.MethodDelete:
+		ah.disconnect(w, r, "", path[1])
+	case len(path) == 1 && path[0] == "announcements" && r.Method == http.MethodPost:
+		ah.announce(w, r)
+	case len(path) > 0 && (path[0] == "connections" || path[0] == "users" || path[0] == "announcements"):
+		ah.writeError(w, r, handler.ErrMethodNotAllowed)
+	default:
+		ah.writeError(w, r, errorcodes.ErrNotFound)
+	}
+}
+
+func (ah *adminHandler) listConnections(w http.ResponseWriter, r *http.Request) {
+	conns, err := ah.hub.Connections(r.Context(), r.URL.Query().Get("userId"))
+	if err != nil {
+		ah.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (ah *adminHandler) disconnect(w http.ResponseWriter, r *http.Request, connID, userID string) {
+	n, err := ah.hub.Disconnect(r.Context(), connID, userID)
+	if err != nil {
+		ah.writeError(w, r, err)
+		return
+	}
+	if n == 0 {
+		ah.writeError(w, r, errorcodes.ErrNotFound)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("disconnected connections", "connectionId", connID, "userId", userID, "connections", n)
+	writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+}
+
+func (ah *adminHandler) announce(w http.ResponseWriter, r *http.Request) {
+	var announcement model.Announcement
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnnouncementSize)).Decode(&announcement)
+	if err == nil {
+		err = announcement.Validate()
+	}
+	if err != nil {
+		ah.writeError(w, r, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+		return
+	}
+	announcement.CreatedAt = time.Now()
+
+	n, err := ah.hub.Announce(r.Context(), announcement)
+	if err != nil {
+		ah.writeError(w, r, err)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("sent announcement", "users", len(announcement.UserIDs), "connections", n)
+	writeJSON(w, http.StatusOK, map[string]int{"sent": n})
+}
+
+func (ah *adminHandler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, status := handler.ClientError(r.Context(), err)
+	writeJSON(w, status, e)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
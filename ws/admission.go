@@ -0,0 +1,149 @@
+package ws
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/metrics"
+	"github.com/shohag000/test-websocket/model"
+)
+
+// admit reserves a connection for the remote address, or returns an error if the instance or the
+// address is at its connection limit. The reservation is released when the registered client is
+// closed, or by release if the client is never registered.
+func (h *Hub) admit(ctx context.Context, ip string) error {
+	var err error
+	doErr := h.do(ctx, func() {
+		switch {
+		case h.config.MaxConnections > 0 && len(h.clients)+h.pending >= h.config.MaxConnections:
+			err = handler.ErrServerBusy
+			metrics.ConnectionRejections.WithLabelValues("instance").Inc()
+		case h.config.MaxConnectionsPerIP > 0 && h.ips[ip] >= h.config.MaxConnectionsPerIP:
+			err = handler.ErrTooManyConnections
+			metrics.ConnectionRejections.WithLabelValues("ip").Inc()
+		default:
+			h.pending++
+			h.ips[ip]++
+		}
+	})
+	if doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+// release gives back a reservation of admit whose client was not registered
+func (h *Hub) release(ip string) {
+	h.do(context.Background(), func() {
+		h.pending--
+		h.forgetIP(ip)
+	})
+}
+
+// forgetIP removes a connection of the remote address
+func (h *Hub) forgetIP(ip string) {
+	h.ips[ip]--
+	if h.ips[ip] <= 0 {
+		delete(h.ips, ip)
+	}
+}
+
+// authenticate marks the client as connected for the user, or returns ErrTooManyConnections if
+// the user is at the connection limit. With EvictOldestConnection the oldest connections of the
+// user are closed to make room for the client instead.
+func (h *Hub) authenticate(ctx context.Context, client *Client, userID string) error {
+	var err error
+	doErr := h.do(ctx, func() {
+		if _, ok := h.clients[client]; !ok {
+			// The connection was closed in the meantime
+			return
+		}
+
+		if max := h.config.MaxConnectionsPerUser; max > 0 {
+			var conns []*Client
+			for c := range h.clients {
+				if c != client && c.Authenticated && c.UserID == userID {
+					conns = append(conns, c)
+				}
+			}
+			if len(conns) >= max && !h.config.EvictOldestConnection {
+				err = handler.ErrTooManyConnections
+				metrics.ConnectionRejections.WithLabelValues("user").Inc()
+				return
+			}
+			if len(conns) >= max {
+				sort.Slice(conns, func(i, j int) bool {
+					return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+				})
+				for _, c := range conns[:len(conns)-max+1] {
+					c.logger().Info("closing oldest connection of the user to admit a new one")
+					h.evict(ctx, c)
+				}
+			}
+		}
+
+		client.UserID = userID
+		client.Authenticated = true
+		client.syncing = true
+		h.presence.add(userID, client)
+	})
+	if doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+// evict tells the client that it was replaced by a newer connection and closes it
+func (h *Hub) evict(ctx context.Context, client *Client) {
+	e, _ := handler.ClientError(ctx, handler.ErrConnectionEvicted)
+	if h.send(client, model.Data{DataType: model.ErrorData, Data: e}) {
+		h.close(client)
+	}
+	metrics.ConnectionEvictions.Inc()
+}
+
+// remoteIP returns the ip address of the client of the request. Behind trusted proxies it is the
+// last address of X-Forwarded-For which was not added by a trusted proxy.
+func remoteIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = hops[i]
+		if !isTrusted(ip, trusted) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// isTrusted reports whether the ip is in one of the trusted networks
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
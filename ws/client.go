@@ -6,18 +6,23 @@ package ws
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/mitchellh/mapstructure"
-	"github.com/shohag000/test-websocket/batman/auth"
 	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/metrics"
 	"github.com/shohag000/test-websocket/model"
-	"github.com/shohag000/test-websocket/repository"
+	"github.com/shohag000/test-websocket/ratelimit"
+	"github.com/shohag000/test-websocket/tracing"
+	"go.opentelemetry.io/otel/api/kv"
 )
 
 const (
@@ -31,7 +36,7 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 16 * 1024
 )
 
 var (
@@ -46,14 +51,46 @@ var upgrader = websocket.Upgrader{
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
+	// Bytes read from and written to the connection, accessed atomically.
+	bytesIn  int64
+	bytesOut int64
+
 	hub *Hub
 
 	// The websocket connection.
 	conn *websocket.Conn
 
+	// ID of the connection in log lines.
+	ID string
+
+	// Address of the peer and the time it connected.
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	// Logger of the connection, it holds the user id once the connection is authenticated.
+	log atomic.Value
+
+	// Context of the connection, it is cancelled when the connection closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// Buffered channel of outbound messages.
 	send chan model.Data
 
+	// Close frame sent once the hub closed the send channel, set by the hub before it closes it.
+	closeMsg []byte
+
+	// Remote address the connection counts against.
+	ip string
+
+	// Live data is held back while the connection catches up, used by the hub only.
+	syncing bool
+	held    []model.Data
+
+	// Rate limits of the connection and the times its requests were limited, used by readPump only.
+	limits  *ratelimit.Buckets
+	strikes []time.Time
+
 	// Authenticated bool type defins if the channel is authenticated with a valid user token
 	Authenticated bool
 
@@ -71,8 +108,20 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
+		c.cancel()
 		c.hub.unregister <- c
 		c.conn.Close()
+
+		// Remember when the user was last seen for the email digest
+		if c.Authenticated {
+			ctx, cancel := context.WithTimeout(context.Background(), c.hub.config.RequestTimeout)
+			err := c.MessagingService.TouchUser(ctx, c.UserID)
+			cancel()
+			if err != nil {
+				c.logger().Error("could not update last seen", "error", err)
+			}
+		}
+		c.hub.conns.Done()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -81,11 +130,14 @@ func (c *Client) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.logger().Warn("connection closed unexpectedly", "error", err)
 			}
 			break
 		}
 
+		metrics.FrameSize.WithLabelValues("inbound").Observe(float64(len(message)))
+		atomic.AddInt64(&c.bytesIn, int64(len(message)))
+
 		// Trim message
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 
@@ -93,182 +145,392 @@ func (c *Client) readPump() {
 		incomingDataStr := string(message)
 		var iData model.Data
 
+		// Handle the request within the request deadline, closing the connection cancels it
+		ctx, cancel := context.WithTimeout(c.ctx, c.hub.config.RequestTimeout)
 		if err = json.Unmarshal([]byte(incomingDataStr), &iData); err != nil {
-			fmt.Printf("could not unmarshal message: %v", err)
+			ctx = logger.NewContext(ctx, c.logger().With("requestId", logger.NewID()))
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			cancel()
+			continue
+		}
+		metrics.InboundFrames.WithLabelValues(iData.DataType.String()).Inc()
+
+		// Reject requests over the rate limits, and disconnect clients which keep sending them
+		now := time.Now()
+		if err = c.allow(iData.DataType, now); err != nil {
+			ctx = logger.NewContext(ctx, c.logger().With("requestId", logger.NewID(), "dataType", iData.DataType))
+			c.sendError(ctx, err)
+			cancel()
+			if c.strike(now) {
+				c.logger().Warn("disconnecting client which keeps exceeding the rate limit", "strikes", len(c.strikes))
+				metrics.RateLimitDisconnects.Inc()
+				closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+				c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+				break
+			}
+			continue
 		}
 
-		// Parse message based on data type
-		switch iData.DataType {
-		case model.InitData:
-			// Initialize the connection, prior to this point the client is connected to the websocket,
-			// however, the client is yet to be authenticated, without authentication the client will
-			// not receive any kind of messages from the server.
+		// Each request is a span, which continues the trace of the client if it passed one
+		ctx, span := tracing.Start(tracing.WithTraceParent(ctx, iData.TraceParent), "ws."+iData.DataType.String(),
+			kv.String("ws.conn_id", c.ID),
+			kv.String("ws.data_type", iData.DataType.String()),
+		)
+		if c.Authenticated {
+			span.SetAttributes(kv.String("enduser.id", c.UserID))
+		}
+		log := c.logger().With("requestId", logger.NewID(), "dataType", iData.DataType, "traceId", span.SpanContext().TraceID.String())
+		start := time.Now()
+		c.handle(logger.NewContext(ctx, log), iData)
+		span.End()
+		cancel()
+		log.Debug("request handled", "duration", time.Since(start))
 
-			// Parse incoming json data
-			var authMsg model.Auth
-			err = mapstructure.Decode(iData.Data, &authMsg)
-			if err != nil {
-				fmt.Printf("could not parse data: %v", err)
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "InvalidData",
-						Details: fmt.Sprintf("Could not parse json data: %v", err),
-					},
-				}
-				continue
-			}
+		// Broadcast
+		// c.hub.broadcast <- messageObj
+	}
+}
 
-			// Validate auth token
-			userID, ok, err := c.MessagingService.AuthenticateToken(authMsg.Token)
-			if err != nil || !ok || userID != authMsg.UserID {
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "InvalidToken",
-						Details: fmt.Sprintf("Could not validate token: %v", err),
-					},
-				}
-				continue
-			}
+// handle handles a request of the client based on its data type
+func (c *Client) handle(ctx context.Context, iData model.Data) {
+	// Every request but the initialization needs an authenticated connection
+	if iData.DataType != model.InitData && !c.Authenticated {
+		c.sendError(ctx, handler.ErrUnauthenticated)
+		return
+	}
 
-			// Register client as authenticated
-			c.UserID = userID
-			c.Authenticated = true
+	var err error
+	switch iData.DataType {
+	case model.InitData:
+		// Initialize the connection, prior to this point the client is connected to the websocket,
+		// however, the client is yet to be authenticated, without authentication the client will
+		// not receive any kind of messages from the server.
 
-			// Find user's inbox
-			inbox, err := c.MessagingService.GetInboxByUserID(authMsg.UserID, 30)
-			if err != nil {
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "Internal",
-						Details: fmt.Sprintf("Could not fetch inbox: %v", err),
-					},
-				}
-				continue
-			}
+		// Parse incoming json data
+		var authMsg model.Auth
+		err = mapstructure.Decode(iData.Data, &authMsg)
+		if err != nil {
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			return
+		}
+
+		// Validate auth token
+		userID, ok, err := c.MessagingService.AuthenticateToken(authMsg.Token)
+		if err != nil || !ok || userID != authMsg.UserID {
+			c.sendError(ctx, handler.ErrInvalidToken)
+			return
+		}
 
-			// Return with user's inbox
-			c.hub.broadcast <- model.Data{
-				DataType: model.InboxData,
-				Data:     inbox,
-				UserID:   authMsg.UserID,
+		// Register client as authenticated, a user with too many connections is disconnected
+		err = c.hub.authenticate(ctx, c, userID)
+		if err != nil {
+			c.sendError(ctx, err)
+			if errors.Is(err, handler.ErrTooManyConnections) {
+				c.hub.unregister <- c
 			}
-			continue
+			return
+		}
+		c.log.Store(logger.Default().With("connId", c.ID, "userId", userID))
+		err = c.MessagingService.TouchUser(ctx, userID)
+		if err != nil {
+			logger.FromContext(ctx).Error("could not update last seen", "error", err)
+		}
 
-		case model.MessageData:
-			// Received message from the client, process the message, store it in database and send
-			// it to the users websocket channel
+		// Live data is held back until the client caught up, so it arrives after the data
+		// the client missed
+		seq, err := c.catchUp(ctx, authMsg.LastSeq)
+		c.hub.synced(c, seq)
+		if err != nil {
+			c.sendError(ctx, err)
+		}
+		return
 
-			// TODO:: Validate message data
-			// TODO:: Store message in database
+	case model.MessageData:
+		// Received message from the client, process the message, store it in database and send
+		// it to the users websocket channel
 
-			// Parse message data
-			var msg model.Message
-			err = mapstructure.Decode(iData.Data, &msg)
-			if err != nil {
-				fmt.Printf("could not parse msg data: %v", err)
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "InvalidData",
-						Details: fmt.Sprintf("Could not parse json data: %v", err),
-					},
-				}
-				continue
-			}
+		// Parse message data
+		var msg model.Message
+		err = mapstructure.Decode(iData.Data, &msg)
+		if err != nil {
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			return
+		}
 
-			// Set msg created at time
-			msg.CreatedAt = time.Now()
+		// Validate message body against its message type
+		err = msg.DecodeBody()
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
 
-			// Store message in database
-			err = c.MessagingService.StoreMessage(&msg)
-			if err != nil {
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "Internal",
-						Details: fmt.Sprintf("Could not save data: %v", err),
-					},
-				}
-				continue
-			}
+		// Set msg created at time
+		msg.CreatedAt = time.Now()
+
+		// Store message in database
+		stored, created, err := c.MessagingService.StoreMessage(ctx, c.UserID, &msg)
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
+
+		// Acknowledge the message to the sender
+		c.hub.broadcast <- model.Data{
+			DataType: model.MessageAckData,
+			Data: model.MessageAck{
+				ClientMessageID: stored.ClientMessageID,
+				Duplicate:       !created,
+				Message:         stored,
+			},
+			UserID: stored.SenderID,
+		}
+
+		// The stored message is delivered to both users by the event bus
+		return
+
+	case model.ThreadData:
+		// Parse message data
+		var getAllMsgReq model.GetMessagesInThreadRequest
+		err = mapstructure.Decode(iData.Data, &getAllMsgReq)
+		if err != nil {
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			return
+		}
+
+		allMsg, err := c.MessagingService.GetAllMessagesByThreadID(ctx, c.UserID, &getAllMsgReq)
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
+
+		c.hub.broadcast <- model.Data{
+			DataType: model.ThreadData,
+			Data:     allMsg,
+			UserID:   c.UserID,
+		}
+		return
+
+	case model.SwapResponseData:
+		// The counterparty accepts or declines a swap agreement card, or the proposer cancels it.
+		// The card is updated in place and both users are notified.
+
+		// Parse swap response data
+		var swapResp model.SwapResponse
+		err = mapstructure.Decode(iData.Data, &swapResp)
+		if err != nil {
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			return
+		}
 
-			// Send data for broadcasting
-			c.hub.broadcast <- model.Data{
-				DataType: model.MessageData,
-				Data:     msg,
-				UserID:   msg.SenderID,
+		_, err = c.MessagingService.RespondToSwapAgreement(ctx, c.UserID, &swapResp)
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
+
+		// The updated card is delivered to both users by the event bus
+		return
+
+	case model.RegisterDeviceData:
+		// Register the device of the user for push notifications
+
+		// Parse device data
+		var device model.Device
+		err = mapstructure.Decode(iData.Data, &device)
+		if err == nil {
+			err = device.Validate()
+		}
+		if err != nil {
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			return
+		}
+
+		err = c.MessagingService.RegisterDevice(ctx, c.UserID, &device)
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
+
+		c.hub.broadcast <- model.Data{
+			DataType: model.RegisterDeviceData,
+			Data:     device,
+			UserID:   c.UserID,
+		}
+		return
+
+	case model.MuteThreadData:
+		// Mute or unmute the push notifications of a thread
+
+		// Parse mute data
+		var mute model.ThreadMute
+		err = mapstructure.Decode(iData.Data, &mute)
+		if err != nil {
+			c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+			return
+		}
+
+		err = c.MessagingService.MuteThread(ctx, c.UserID, &mute)
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
+
+		c.hub.broadcast <- model.Data{
+			DataType: model.MuteThreadData,
+			Data:     mute,
+			UserID:   c.UserID,
+		}
+		return
+
+	case model.UserSettingsData:
+		// Return the settings of the user, or update them if settings are passed
+
+		if iData.Data != nil {
+			// Parse settings data
+			var settings model.UserSettings
+			err = mapstructure.Decode(iData.Data, &settings)
+			if err == nil {
+				err = settings.Validate()
 			}
-			c.hub.broadcast <- model.Data{
-				DataType: model.MessageData,
-				Data:     msg,
-				UserID:   msg.ReceiverID,
+			if err != nil {
+				c.sendError(ctx, fmt.Errorf("%w: %v", handler.ErrInvalidData, err))
+				return
 			}
-			continue
 
-		case model.ThreadData:
-			// Parse message data
-			var getAllMsgReq model.GetMessagesInThreadRequest
-			err = mapstructure.Decode(iData.Data, &getAllMsgReq)
+			err = c.MessagingService.UpdateUserSettings(ctx, c.UserID, &settings)
 			if err != nil {
-				fmt.Printf("could not parse GetMessagesInThreadRequest data: %v", err)
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "InvalidData",
-						Details: fmt.Sprintf("Could not parse json data: %v", err),
-					},
-				}
-				continue
+				c.sendError(ctx, err)
+				return
 			}
+		}
 
-			allMsg, err := c.MessagingService.GetAllMessagesByThreadID(
-				getAllMsgReq.ThreadID,
-				int64(getAllMsgReq.Limit),
-				int64(getAllMsgReq.Skip),
-			)
-			if err != nil {
-				// Return error message
-				c.hub.broadcast <- model.Data{
-					DataType: model.ErrorData,
-					Data: model.Error{
-						Code:    "Internal",
-						Details: fmt.Sprintf("Could not fetch messages in thread: %v", err),
+		settings, err := c.MessagingService.GetUserSettings(ctx, c.UserID)
+		if err != nil {
+			c.sendError(ctx, err)
+			return
+		}
+
+		c.hub.broadcast <- model.Data{
+			DataType: model.UserSettingsData,
+			Data:     settings,
+			UserID:   c.UserID,
+		}
+		return
+
+	default:
+		// Handle invalid data type
+		c.sendError(ctx, fmt.Errorf("%w: '%v'", handler.ErrInvalidDataType, iData.DataType))
+		return
+	}
+}
+
+// catchUp sends the events the client missed since the seq to the client, or the whole inbox if it
+// did not pass a seq or missed too many events, and returns the seq the client caught up to
+func (c *Client) catchUp(ctx context.Context, lastSeq int64) (int64, error) {
+	if lastSeq > 0 {
+		events, err := c.MessagingService.GetEventsSince(ctx, c.UserID, lastSeq)
+		if err == nil {
+			for _, e := range events {
+				c.hub.reply <- reply{
+					client: c,
+					data: model.Data{
+						DataType: e.DataType,
+						Data:     e.Data,
+						Seq:      e.Seq,
+						UserID:   c.UserID,
 					},
 				}
-				continue
+				lastSeq = e.Seq
 			}
+			return lastSeq, nil
+		}
+		if !errors.Is(err, handler.ErrCatchUpTooLarge) {
+			logger.FromContext(ctx).Error("could not fetch missed events", "error", err)
+		}
+	}
 
-			c.hub.broadcast <- model.Data{
-				DataType: model.ThreadData,
-				Data:     allMsg,
-				UserID:   c.UserID,
-			}
-			continue
+	// Find user's inbox
+	inbox, err := c.MessagingService.GetInboxByUserID(ctx, c.UserID, 30)
+	if err != nil {
+		return 0, err
+	}
 
-		default:
-			// Handle invalid data type
-			c.hub.broadcast <- model.Data{
-				DataType: model.ErrorData,
-				Data: model.Error{
-					Code:    "InvalidDataType",
-					Details: fmt.Sprintf("Invalid data type '%v' passed.", iData.DataType),
-				},
-			}
-			continue
+	// Return with user's inbox
+	c.hub.reply <- reply{
+		client: c,
+		data: model.Data{
+			DataType: model.InboxData,
+			Data:     inbox,
+			UserID:   c.UserID,
+		},
+	}
+	return inbox.LastSeq, nil
+}
+
+// sendError sends the client error of err to this connection only
+func (c *Client) sendError(ctx context.Context, err error) {
+	e, _ := handler.ClientError(ctx, err)
+	c.hub.reply <- reply{
+		client: c,
+		data:   model.Data{DataType: model.ErrorData, Data: e},
+	}
+}
+
+// allow checks the rate limits of the connection and of its user for the data type, and returns
+// the error to send to the client if the request is limited
+func (c *Client) allow(dataType model.DataType, now time.Time) error {
+	limit, ok := c.hub.config.RateLimits[dataType.String()]
+	if !ok {
+		limit = c.hub.config.RateLimits["*"]
+	}
+
+	scope := "connection"
+	ok, retryAfter := c.limits.Take(dataType.String(), ratelimit.Limit{Rate: limit.ConnectionRate, Burst: limit.ConnectionBurst}, now)
+	if ok && c.Authenticated {
+		scope = "user"
+		ok, retryAfter = c.hub.userLimits.Take(c.UserID+"/"+dataType.String(), ratelimit.Limit{Rate: limit.UserRate, Burst: limit.UserBurst}, now)
+	}
+	if ok {
+		return nil
+	}
+
+	metrics.RateLimited.WithLabelValues(dataType.String(), scope).Inc()
+	return &handler.RateLimitError{RetryAfter: retryAfter}
+}
+
+// strike records a limited request and reports whether the connection was limited too often
+// within the strike window
+func (c *Client) strike(now time.Time) bool {
+	kept := c.strikes[:0]
+	for _, t := range c.strikes {
+		if now.Sub(t) < c.hub.config.RateLimitStrikeWindow {
+			kept = append(kept, t)
 		}
+	}
+	c.strikes = append(kept, now)
+	return c.hub.config.RateLimitStrikes > 0 && len(c.strikes) >= c.hub.config.RateLimitStrikes
+}
 
-		// Broadcast
-		// c.hub.broadcast <- messageObj
+// info returns the details of the connection
+func (c *Client) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ConnectionID:  c.ID,
+		Authenticated: c.Authenticated,
+		RemoteAddr:    c.RemoteAddr,
+		ConnectedAt:   c.ConnectedAt,
+		BytesIn:       atomic.LoadInt64(&c.bytesIn),
+		BytesOut:      atomic.LoadInt64(&c.bytesOut),
+		SendQueue:     len(c.send),
+	}
+	if c.Authenticated {
+		info.UserID = c.UserID
 	}
+	return info
+}
+
+// logger returns the logger of the connection
+func (c *Client) logger() *logger.Logger {
+	return c.log.Load().(*logger.Logger)
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -280,6 +542,7 @@ func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
+		c.cancel()
 		c.conn.Close()
 	}()
 	for {
@@ -288,7 +551,7 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
 				return
 			}
 
@@ -300,25 +563,32 @@ func (c *Client) writePump() {
 			// Jsonify message data
 			messageByte, err := json.Marshal(message)
 			if err != nil {
-				fmt.Printf("could not marshal data: %v", err)
+				c.logger().Error("could not marshal data", "dataType", message.DataType, "error", err)
 			}
 			w.Write(messageByte)
+			metrics.OutboundFrames.WithLabelValues(message.DataType.String()).Inc()
+			size := len(messageByte)
 
 			// Add queued chat messages to the current websocket message.
 			n := len(c.send)
 			for i := 0; i < n; i++ {
 				w.Write(newline)
 				// Jsonify message data
-				messageByte, err := json.Marshal(<-c.send)
+				queued := <-c.send
+				messageByte, err := json.Marshal(queued)
 				if err != nil {
-					fmt.Printf("could not marshal data: %v", err)
+					c.logger().Error("could not marshal data", "dataType", queued.DataType, "error", err)
 				}
 				w.Write(messageByte)
+				metrics.OutboundFrames.WithLabelValues(queued.DataType.String()).Inc()
+				size += len(newline) + len(messageByte)
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+			metrics.FrameSize.WithLabelValues("outbound").Observe(float64(size))
+			atomic.AddInt64(&c.bytesOut, int64(size))
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -329,33 +599,43 @@ func (c *Client) writePump() {
 }
 
 // ServeWs handles websocket requests from the peer.
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	conn, err := upgrader.Upgrade(w, r, nil)
+func ServeWs(hub *Hub, service handler.MessagingService, w http.ResponseWriter, r *http.Request) {
+	// Reject the connection before upgrading it if the instance or the address is at its limit
+	ip := remoteIP(r, hub.config.TrustedProxies)
+	err := hub.admit(r.Context(), ip)
 	if err != nil {
-		log.Println(err)
+		e, status := handler.ClientError(r.Context(), err)
+		writeJSON(w, status, e)
 		return
 	}
 
-	// Get db client
-	dbClient, err := repository.GetDBClient()
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		logger.Default().Warn("could not upgrade connection", "error", err)
+		hub.release(ip)
 		return
 	}
 
-	// Get repository
-	repo := repository.NewMongoRepository(dbClient)
-
+	ctx, cancel := context.WithCancel(context.Background())
 	client := &Client{
 		hub:              hub,
 		conn:             conn,
+		ctx:              ctx,
+		cancel:           cancel,
 		send:             make(chan model.Data, 256),
+		limits:           ratelimit.New(),
 		Authenticated:    false,
-		MessagingService: handler.NewService(repo, auth.New()),
+		MessagingService: service,
 		UserID:           "-1",
+		ID:               logger.NewID(),
+		RemoteAddr:       r.RemoteAddr,
+		ip:               ip,
+		ConnectedAt:      time.Now(),
 	}
+	client.log.Store(logger.Default().With("connId", client.ID))
 
+	client.hub.conns.Add(1)
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/ratelimit"
+)
+
+func newTestHub(cfg config.Config) *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		presence:   newPresence(),
+		ips:        make(map[string]int),
+		userLimits: ratelimit.New(),
+		config:     cfg,
+	}
+}
+
+func newTestClient(hub *Hub, userID string) *Client {
+	return &Client{
+		hub:           hub,
+		limits:        ratelimit.New(),
+		Authenticated: userID != "",
+		UserID:        userID,
+	}
+}
+
+func TestAllow(t *testing.T) {
+	hub := newTestHub(config.Config{
+		RateLimits: map[string]config.RateLimit{
+			"*":           {ConnectionRate: 1, ConnectionBurst: 2, UserRate: 1, UserBurst: 3},
+			"MessageData": {ConnectionRate: 1, ConnectionBurst: 1, UserRate: 1, UserBurst: 1},
+		},
+	})
+	now := time.Now()
+
+	// The burst of a connection
+	c1 := newTestClient(hub, "u1")
+	for i := 0; i < 2; i++ {
+		if err := c1.allow(model.InboxData, now); err != nil {
+			t.Fatalf("request %d of the burst was limited: %v", i, err)
+		}
+	}
+	err := c1.allow(model.InboxData, now)
+	var rateLimitErr *handler.RateLimitError
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.RetryAfter != time.Second {
+		t.Fatalf("got %v, want a rate limit error with a retry after of 1s", err)
+	}
+
+	// The user limit is shared by the connections of the user
+	c2 := newTestClient(hub, "u1")
+	if err := c2.allow(model.InboxData, now); err != nil {
+		t.Fatalf("request within the user burst was limited: %v", err)
+	}
+	if err := c2.allow(model.InboxData, now); !errors.Is(err, handler.ErrRateLimited) {
+		t.Fatalf("request over the user burst was not limited: %v", err)
+	}
+
+	// Data types have their own buckets and limits
+	if err := c1.allow(model.InitData, now); err != nil {
+		t.Fatalf("request of another data type was limited: %v", err)
+	}
+	c3 := newTestClient(hub, "u2")
+	c3.allow(model.MessageData, now)
+	if err := c3.allow(model.MessageData, now); !errors.Is(err, handler.ErrRateLimited) {
+		t.Fatalf("request over the data type limit was not limited: %v", err)
+	}
+}
+
+func TestStrike(t *testing.T) {
+	hub := newTestHub(config.Config{RateLimitStrikes: 3, RateLimitStrikeWindow: time.Minute})
+	c := newTestClient(hub, "u1")
+	now := time.Now()
+
+	if c.strike(now) || c.strike(now.Add(time.Second)) {
+		t.Fatal("client was disconnected before reaching the strikes")
+	}
+	if !c.strike(now.Add(2 * time.Second)) {
+		t.Fatal("client was not disconnected after reaching the strikes")
+	}
+
+	// Strikes outside of the window are forgotten
+	c = newTestClient(hub, "u1")
+	c.strike(now)
+	c.strike(now.Add(time.Second))
+	if c.strike(now.Add(2 * time.Minute)) {
+		t.Fatal("strikes outside of the window were counted")
+	}
+}
@@ -0,0 +1,77 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/repository"
+	"github.com/shohag000/test-websocket/tracing"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// FanOut returns the event bus handler which delivers stored messages and swap agreement
+// updates to both users of the thread
+func FanOut(hub *Hub, service handler.MessagingService) eventbus.Handler {
+	return func(e eventbus.Event) error {
+		msg, ok := e.Data.(*model.Message)
+		if !ok {
+			return nil
+		}
+
+		var dataType model.DataType
+		switch e.Name {
+		case model.EventMessageStored:
+			dataType = model.MessageData
+		case model.EventSwapAgreementUpdated:
+			dataType = model.SwapResponseData
+		default:
+			return nil
+		}
+
+		ctx, span := tracing.Start(tracing.WithTraceParent(context.Background(), e.TraceParent), "ws.fanout",
+			kv.String("event.name", e.Name),
+			kv.String("event.id", e.ID),
+		)
+		defer span.End()
+		return deliver(ctx, hub, service, e.ID, dataType, msg, msg.SenderID, msg.ReceiverID)
+	}
+}
+
+// deliver records the data in the sync log of each user and sends it to their connections. Users
+// who are offline receive it from the sync log when they reconnect. An event which was already
+// recorded for a user has been delivered before and is skipped. Data which could not be recorded
+// is not sent either, the error makes the event publish again.
+func deliver(ctx context.Context, hub *Hub, service handler.MessagingService, eventID string, dataType model.DataType, data interface{}, userIDs ...string) error {
+	var failed error
+	for i, userID := range userIDs {
+		if i > 0 && userID == userIDs[i-1] {
+			continue
+		}
+
+		d := model.Data{
+			DataType: dataType,
+			Data:     data,
+			UserID:   userID,
+		}
+		log := logger.Default().With("eventId", eventID, "userId", userID, "dataType", dataType)
+		rctx, cancel := context.WithTimeout(logger.NewContext(ctx, log), hub.config.RequestTimeout)
+		event, err := service.RecordEvent(rctx, userID, eventID, dataType, data)
+		cancel()
+		if err != nil {
+			if errors.Is(err, repository.ErrDuplicateEvent) {
+				continue
+			}
+			log.Error("could not record event", "error", err)
+			failed = fmt.Errorf("could not record event of user %s: %v", userID, err)
+			continue
+		}
+		d.Seq = event.Seq
+		hub.broadcast <- d
+	}
+	return failed
+}
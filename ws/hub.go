@@ -1,9 +1,21 @@
 package ws
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/metrics"
 	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/ratelimit"
 )
 
+// maxHeld is the number of live messages held back for a client which is catching up
+const maxHeld = 1024
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -14,20 +26,58 @@ type Hub struct {
 	// broadcast chan []byte
 	broadcast chan model.Data
 
+	// Replies to the connection which sent a request, such as errors.
+	reply chan reply
+
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Functions which run in the hub loop, such as admin requests which access the clients.
+	exec chan func()
+
+	// Authenticated connections of each user.
+	presence *presence
+
+	// Connections of each remote address, and connections which are admitted but not registered.
+	ips     map[string]int
+	pending int
+
+	// Rate limits of each user across their connections.
+	userLimits *ratelimit.Buckets
+
+	// Goroutines of the connections, and whether the hub closes connections as it shuts down.
+	conns        sync.WaitGroup
+	shuttingDown bool
+
+	config config.Config
+}
+
+// goingAway is the close frame of connections closed by a shutdown, clients reconnect to another
+// instance
+var goingAway = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+
+// reply is data for a single connection
+type reply struct {
+	client *Client
+	data   model.Data
 }
 
 // NewHub returns a new hub
 func NewHub() *Hub {
 	return &Hub{
 		broadcast:  make(chan model.Data),
+		reply:      make(chan reply),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		exec:       make(chan func()),
 		clients:    make(map[*Client]bool),
+		presence:   newPresence(),
+		ips:        make(map[string]int),
+		userLimits: ratelimit.New(),
+		config:     config.New(),
 	}
 }
 
@@ -37,25 +87,213 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			h.pending--
+			metrics.Connections.Set(float64(len(h.clients)))
+			client.logger().Debug("connection registered", "connections", len(h.clients))
+			if h.shuttingDown {
+				client.closeMsg = goingAway
+				h.close(client)
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.close(client)
+				client.logger().Debug("connection unregistered", "connections", len(h.clients))
+			}
+		case fn := <-h.exec:
+			fn()
+		case r := <-h.reply:
+			if _, ok := h.clients[r.client]; ok {
+				h.send(r.client, r.data)
 			}
 		case iData := <-h.broadcast:
 			for client := range h.clients {
 				// Send message to a particular user only
-				if (client.UserID != iData.UserID) && iData.DataType != model.ErrorData {
+				if client.UserID != iData.UserID {
 					continue
 				}
+				h.sendLive(client, iData)
+			}
+		}
+	}
+}
 
-				select {
-				case client.send <- iData:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+// send queues the data on the client and reports whether it was queued, a client which does not
+// keep up is dropped
+func (h *Hub) send(client *Client, data model.Data) bool {
+	select {
+	case client.send <- data:
+		return true
+	default:
+		client.logger().Warn("send buffer is full, dropping connection", "dataType", data.DataType)
+		h.close(client)
+		metrics.DroppedClients.Inc()
+		return false
+	}
+}
+
+// sendLive sends live data to the client, or holds it back while the client catches up. A client
+// which does not catch up before too much data is held back is dropped.
+func (h *Hub) sendLive(client *Client, data model.Data) {
+	if !client.syncing {
+		h.send(client, data)
+		return
+	}
+	if len(client.held) >= maxHeld {
+		client.logger().Warn("too much live data held back while catching up, dropping connection")
+		h.close(client)
+		metrics.DroppedClients.Inc()
+		return
+	}
+	client.held = append(client.held, data)
+}
+
+// synced sends the live data held back while the client caught up to the seq, except the data
+// the client caught up on, and lets live data through from now on
+func (h *Hub) synced(client *Client, seq int64) {
+	h.do(context.Background(), func() {
+		held := client.held
+		client.held, client.syncing = nil, false
+		if _, ok := h.clients[client]; !ok {
+			return
+		}
+		for _, d := range held {
+			if d.Seq > 0 && d.Seq <= seq {
+				continue
+			}
+			if !h.send(client, d) {
+				return
 			}
 		}
+	})
+}
+
+// close forgets the client and closes its send channel, which closes the connection
+func (h *Hub) close(client *Client) {
+	close(client.send)
+	delete(h.clients, client)
+	h.presence.remove(client)
+	h.forgetIP(client.ip)
+	metrics.Connections.Set(float64(len(h.clients)))
+}
+
+// Shutdown closes every connection with a going away close frame, and waits until the
+// connections are done or the context is done. Connections which register afterwards are closed
+// right away.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	err := h.do(ctx, func() {
+		h.shuttingDown = true
+		for client := range h.clients {
+			client.closeMsg = goingAway
+			h.close(client)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("connections did not close: %v", ctx.Err())
+	}
+}
+
+// do runs fn in the hub loop, where it can access the clients. The caller must not use the
+// results of fn if do returns an error.
+func (h *Hub) do(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case h.exec <- func() { fn(); close(done) }:
+	case <-ctx.Done():
+		return fmt.Errorf("hub is not responding: %v", ctx.Err())
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("hub is not responding: %v", ctx.Err())
+	}
+}
+
+// Ping returns an error if the hub does not answer before the context is done
+func (h *Hub) Ping(ctx context.Context) error {
+	return h.do(ctx, func() {})
+}
+
+// Connections returns the open connections, or the connections of the user if a user id is passed
+func (h *Hub) Connections(ctx context.Context, userID string) ([]ConnectionInfo, error) {
+	var conns []ConnectionInfo
+	err := h.do(ctx, func() {
+		conns = make([]ConnectionInfo, 0, len(h.clients))
+		for client := range h.clients {
+			if userID == "" || (client.Authenticated && client.UserID == userID) {
+				conns = append(conns, client.info())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns, nil
+}
+
+// Disconnect closes the connection with the id, or all connections of the user with the id, and
+// returns the number of closed connections
+func (h *Hub) Disconnect(ctx context.Context, connID, userID string) (int, error) {
+	n := 0
+	err := h.do(ctx, func() {
+		for client := range h.clients {
+			if (connID != "" && client.ID == connID) || (userID != "" && client.Authenticated && client.UserID == userID) {
+				client.logger().Info("disconnecting connection by admin request")
+				h.close(client)
+				n++
+			}
+		}
+	})
+	return n, err
+}
+
+// Announce sends the announcement to the authenticated connections of its users, or of all users
+// if it has none, and returns the number of connections it was sent to. Users who are not
+// connected do not receive it.
+func (h *Hub) Announce(ctx context.Context, announcement model.Announcement) (int, error) {
+	users := make(map[string]bool, len(announcement.UserIDs))
+	for _, userID := range announcement.UserIDs {
+		users[userID] = true
+	}
+	data := model.Data{
+		DataType: model.AnnouncementData,
+		Data: model.Announcement{
+			Text:      announcement.Text,
+			CreatedAt: announcement.CreatedAt,
+		},
+	}
+
+	n := 0
+	err := h.do(ctx, func() {
+		for client := range h.clients {
+			if !client.Authenticated || (len(users) > 0 && !users[client.UserID]) {
+				continue
+			}
+			if h.send(client, data) {
+				n++
+			}
+		}
+	})
+	return n, err
+}
+
+// IsOnline reports whether the user has at least one authenticated connection
+func (h *Hub) IsOnline(userID string) bool {
+	return h.presence.isOnline(userID)
 }
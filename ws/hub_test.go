@@ -0,0 +1,98 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/logger"
+	"github.com/shohag000/test-websocket/model"
+)
+
+func TestLiveDataIsHeldBackWhileCatchingUp(t *testing.T) {
+	hub := NewHub()
+	hub.config = config.Config{}
+	go hub.Run()
+
+	c := newTestClient(hub, "")
+	c.send = make(chan model.Data, 16)
+	c.log.Store(logger.Default())
+	hub.pending++
+	hub.register <- c
+	err := hub.authenticate(context.Background(), c, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Live data of the catch up and after it arrives while the client catches up
+	hub.broadcast <- model.Data{DataType: model.MessageData, Seq: 5, UserID: "u1"}
+	hub.broadcast <- model.Data{DataType: model.MessageData, Seq: 7, UserID: "u1"}
+	hub.reply <- reply{client: c, data: model.Data{DataType: model.MessageData, Seq: 5, UserID: "u1"}}
+	hub.reply <- reply{client: c, data: model.Data{DataType: model.MessageData, Seq: 6, UserID: "u1"}}
+	hub.synced(c, 6)
+	hub.broadcast <- model.Data{DataType: model.MessageData, Seq: 8, UserID: "u1"}
+	hub.Ping(context.Background())
+
+	var seqs []int64
+	for len(c.send) > 0 {
+		seqs = append(seqs, (<-c.send).Seq)
+	}
+	want := []int64{5, 6, 7, 8}
+	if len(seqs) != len(want) {
+		t.Fatalf("got seqs %v, want %v", seqs, want)
+	}
+	for i := range want {
+		if seqs[i] != want[i] {
+			t.Fatalf("got seqs %v, want %v", seqs, want)
+		}
+	}
+}
+
+func TestShutdownClosesConnections(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, nil, w, r)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = hub.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, _ := hub.Connections(ctx, "")
+	if len(conns) != 0 {
+		t.Errorf("hub has %d connections after the shutdown", len(conns))
+	}
+
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("connection closed with %v, want a going away close frame", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("connection was not closed")
+	}
+}
@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"sync"
+
+	"github.com/shohag000/test-websocket/metrics"
+)
+
+// presence tracks the authenticated connections of each user, it is safe for concurrent use
+type presence struct {
+	mu      sync.RWMutex
+	users   map[string]map[*Client]bool
+	clients map[*Client]string
+}
+
+func newPresence() *presence {
+	return &presence{
+		users:   make(map[string]map[*Client]bool),
+		clients: make(map[*Client]string),
+	}
+}
+
+// add marks the client as connected for the user
+func (p *presence) add(userID string, c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeLocked(c)
+	if p.users[userID] == nil {
+		p.users[userID] = make(map[*Client]bool)
+	}
+	p.users[userID][c] = true
+	p.clients[c] = userID
+	metrics.AuthenticatedConnections.Set(float64(len(p.clients)))
+}
+
+// remove forgets the client
+func (p *presence) remove(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeLocked(c)
+	metrics.AuthenticatedConnections.Set(float64(len(p.clients)))
+}
+
+func (p *presence) removeLocked(c *Client) {
+	userID, ok := p.clients[c]
+	if !ok {
+		return
+	}
+	delete(p.clients, c)
+	delete(p.users[userID], c)
+	if len(p.users[userID]) == 0 {
+		delete(p.users, userID)
+	}
+}
+
+// isOnline reports whether the user has at least one authenticated connection
+func (p *presence) isOnline(userID string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.users[userID]) > 0
+}
@@ -0,0 +1,188 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shohag000/test-websocket/batman/auth"
+	"github.com/shohag000/test-websocket/batman/errorcodes"
+	"github.com/shohag000/test-websocket/config"
+	"github.com/shohag000/test-websocket/eventbus"
+	"github.com/shohag000/test-websocket/handler"
+	"github.com/shohag000/test-websocket/model"
+	"github.com/shohag000/test-websocket/outbox"
+	"github.com/shohag000/test-websocket/repository"
+	"github.com/shohag000/test-websocket/tracing"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+)
+
+// fakeAuth accepts user ids as their tokens
+type fakeAuth struct{}
+
+func (fakeAuth) DecodeToken(token string) (*auth.User, error) {
+	return &auth.User{UserID: token}, nil
+}
+
+// traceRepo stores messages in an in-memory outbox, it traces them like the mongo repository
+type traceRepo struct {
+	repository.MessagingRepository
+
+	mu     sync.Mutex
+	outbox []*model.OutboxEntry
+	seq    int64
+}
+
+func (tr *traceRepo) TouchUser(ctx context.Context, userID string, seenAt time.Time) error {
+	return nil
+}
+
+func (tr *traceRepo) GetLastEventSeq(ctx context.Context, userID string) (int64, error) {
+	return 0, nil
+}
+
+func (tr *traceRepo) GetInboxByUserID(ctx context.Context, userID string, messageLimit int64) (*model.Inbox, error) {
+	return &model.Inbox{}, nil
+}
+
+func (tr *traceRepo) FindOrCreateThread(ctx context.Context, thread *model.Thread) (*model.Thread, bool, error) {
+	return thread, true, nil
+}
+
+func (tr *traceRepo) StoreMessage(ctx context.Context, message *model.Message) error {
+	ctx, span := tracing.Start(ctx, "repository.StoreMessage")
+	defer span.End()
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.outbox = append(tr.outbox, &model.OutboxEntry{
+		EntryID:     "entry",
+		Event:       model.EventMessageStored,
+		Message:     message,
+		TraceParent: tracing.TraceParent(ctx),
+	})
+	return nil
+}
+
+func (tr *traceRepo) AppendEvent(ctx context.Context, event *model.Event) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.seq++
+	event.Seq = tr.seq
+	return nil
+}
+
+func (tr *traceRepo) ClaimOutboxEntry(ctx context.Context, lease time.Duration) (*model.OutboxEntry, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.outbox) == 0 {
+		return nil, errorcodes.ErrNotFound
+	}
+	entry := tr.outbox[0]
+	tr.outbox = tr.outbox[1:]
+	return entry, nil
+}
+
+func (tr *traceRepo) MarkOutboxPublished(ctx context.Context, entryID string) error {
+	return nil
+}
+
+func (tr *traceRepo) WatchOutbox(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported")
+}
+
+// readUntil reads data from the connection until data of the type arrives
+func readUntil(t *testing.T, conn *websocket.Conn, dataType model.DataType) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var d model.Data
+		err := conn.ReadJSON(&d)
+		if err != nil {
+			t.Fatalf("could not read %v: %v", dataType, err)
+		}
+		if d.DataType == dataType {
+			return
+		}
+	}
+}
+
+func TestTraceOfMessage(t *testing.T) {
+	exporter := &tracing.MemoryExporter{}
+	err := tracing.Use(exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &traceRepo{}
+	service := handler.NewService(repo, fakeAuth{}, nil)
+	hub := NewHub()
+	go hub.Run()
+	bus := eventbus.New()
+	bus.SubscribeAll(FanOut(hub, service))
+	relay := outbox.NewRelay(repo, bus, config.Config{
+		OutboxPollInterval: 10 * time.Millisecond,
+		OutboxLease:        time.Minute,
+		RequestTimeout:     time.Second,
+	})
+	go relay.Run()
+	defer relay.Stop(context.Background())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, service, w, r)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(model.Data{DataType: model.InitData, Data: model.Auth{Token: "u1", UserID: "u1"}})
+	readUntil(t, conn, model.InboxData)
+
+	// The client continues its own trace
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	conn.WriteJSON(model.Data{
+		DataType:    model.MessageData,
+		Data:        map[string]interface{}{"receiverId": "u2", "messageType": "Text", "messageBody": "hi"},
+		TraceParent: "00-" + traceID + "-" + parentID + "-01",
+	})
+	readUntil(t, conn, model.MessageData)
+
+	spans := map[string]*export.SpanData{}
+	deadline := time.Now().Add(5 * time.Second)
+	for spans["ws.fanout"] == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		for _, s := range exporter.Spans() {
+			if s.SpanContext.TraceID.String() == traceID {
+				spans[s.Name] = s
+			}
+		}
+	}
+
+	// Each span is the child of the one before it
+	parent := parentID
+	for _, name := range []string{
+		"ws.MessageData",
+		"MessagingService.StoreMessage",
+		"repository.StoreMessage",
+		"outbox.publish",
+		"ws.fanout",
+		"MessagingService.RecordEvent",
+	} {
+		s, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span in the trace of the client", name)
+		}
+		if s.ParentSpanID.String() != parent {
+			t.Errorf("parent of %s is %s, want %s", name, s.ParentSpanID, parent)
+		}
+		parent = s.SpanContext.SpanID.String()
+	}
+}